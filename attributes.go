@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Targets of an attribute rule.
+const (
+	attributeTargetFormat = "format"
+	attributeTargetClub   = "club"
+	attributeTargetTag    = "tag"
+)
+
+// attributeRule maps an SQS message attribute to the metrics of the
+// message. It is written ATTRIBUTE=TARGET, where TARGET is "format" to
+// select the message format, "club" to set the club_name tag, or "tag:NAME"
+// to add the attribute as the NAME tag, eg. "distribution=tag:distribution".
+type attributeRule struct {
+	Attribute string
+	Target    string
+	Tag       string
+}
+
+func parseAttributeRules(rules []string) ([]attributeRule, error) {
+	var parsed []attributeRule
+	for _, v := range rules {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("attribute rule %q is not ATTRIBUTE=TARGET", v)
+		}
+		r := attributeRule{Attribute: parts[0], Target: parts[1]}
+		if strings.HasPrefix(r.Target, attributeTargetTag+":") {
+			r.Target, r.Tag = attributeTargetTag, strings.TrimPrefix(r.Target, attributeTargetTag+":")
+		}
+		switch {
+		case r.Target == attributeTargetTag && r.Tag == "":
+			return nil, fmt.Errorf("attribute rule %q has no tag name", v)
+		case r.Target != attributeTargetFormat && r.Target != attributeTargetClub && r.Target != attributeTargetTag:
+			return nil, fmt.Errorf("attribute rule %q has unknown target %q", v, r.Target)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// attributeNames returns the message attributes the queue's messages are
+// received with.
+func (q *queue) attributeNames() []string {
+	names := []string{config.SqsMessageAttributeNames, config.SqsEncodingAttributeName}
+	for _, r := range q.rules {
+		names = append(names, r.Attribute)
+	}
+	return names
+}
+
+// messageSettings returns the format and tags of a message: the queue's,
+// overridden by the queue's attribute rules. A message without a rule's
+// attribute keeps the queue's setting. The tags added by tag:NAME rules are
+// returned apart, as they are record tags subject to the metric allowlists
+// and cardinality limits rather than tags every metric is sent with.
+func (q *queue) messageSettings(msg *sqs.Message) (string, []string, []string, error) {
+	format, club := q.Format, q.Club
+	var extra []string
+	for _, r := range q.rules {
+		a, ok := msg.MessageAttributes[r.Attribute]
+		if !ok || a.StringValue == nil || *a.StringValue == "" {
+			continue
+		}
+		v := *a.StringValue
+		switch r.Target {
+		case attributeTargetFormat:
+			if !validFormat(v) {
+				return "", nil, nil, fmt.Errorf("message attribute %s has unknown format %q", r.Attribute, v)
+			}
+			format = v
+		case attributeTargetClub:
+			club = v
+		case attributeTargetTag:
+			extra = append(extra, createTag(r.Tag, tagValue(v)))
+		}
+	}
+	return format, appendTags(createTag("club_name", club), createTag("queue", q.Name)), extra, nil
+}
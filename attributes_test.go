@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-test/deep"
+)
+
+func TestParseAttributeRules(t *testing.T) {
+	actual, err := parseAttributeRules([]string{"distribution=tag:distribution", " log-format=format", "", "club=club"})
+	if err != nil {
+		t.Fatalf("parseAttributeRules: unexpected error %v", err)
+	}
+	expected := []attributeRule{
+		{Attribute: "distribution", Target: "tag", Tag: "distribution"},
+		{Attribute: "log-format", Target: "format"},
+		{Attribute: "club", Target: "club"},
+	}
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Errorf("parseAttributeRules: %v", diff)
+	}
+
+	for _, tt := range []string{"distribution", "=format", "distribution=tag:", "distribution=queue"} {
+		if _, err := parseAttributeRules([]string{tt}); err == nil {
+			t.Errorf("parseAttributeRules(%s): expected error, actual nil", tt)
+		}
+	}
+}
+
+func TestMessageSettings(t *testing.T) {
+	rules, err := parseAttributeRules([]string{"distribution=tag:distribution", "environment=tag:env", "log-format=format", "club=club"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &queue{Name: "cdn", Club: "test", Format: formatJSON, rules: rules}
+	attribute := func(v string) *sqs.MessageAttributeValue {
+		return &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+
+	var data = []struct {
+		attributes map[string]*sqs.MessageAttributeValue
+		format     string
+		tags       []string
+		extra      []string
+	}{
+		{nil, formatJSON, []string{"club_name:test", "queue:cdn"}, nil},
+		{
+			map[string]*sqs.MessageAttributeValue{
+				"distribution": attribute("E2QWRUHAPOMQZL"),
+				"log-format":   attribute("w3c"),
+				"club":         attribute("syd"),
+				"other":        attribute("ignored"),
+			},
+			formatW3C,
+			[]string{"club_name:syd", "queue:cdn"},
+			[]string{"distribution:E2QWRUHAPOMQZL"},
+		},
+		{
+			map[string]*sqs.MessageAttributeValue{
+				"environment":  attribute("production,eu"),
+				"distribution": attribute("E2QWRUHAPOMQZL"),
+				"log-format":   attribute(""),
+			},
+			formatJSON,
+			[]string{"club_name:test", "queue:cdn"},
+			[]string{"distribution:E2QWRUHAPOMQZL", "env:production_eu"},
+		},
+	}
+
+	for _, tt := range data {
+		format, tags, extra, err := q.messageSettings(&sqs.Message{MessageAttributes: tt.attributes})
+		if err != nil {
+			t.Errorf("messageSettings(%v): unexpected error %v", tt.attributes, err)
+			continue
+		}
+		if format != tt.format {
+			t.Errorf("messageSettings(%v): expected format %s, actual %s", tt.attributes, tt.format, format)
+		}
+		if diff := deep.Equal(tags, tt.tags); diff != nil {
+			t.Errorf("messageSettings(%v): expected tags %v, actual %v", tt.attributes, tt.tags, tags)
+		}
+		if diff := deep.Equal(extra, tt.extra); diff != nil {
+			t.Errorf("messageSettings(%v): expected attribute tags %v, actual %v", tt.attributes, tt.extra, extra)
+		}
+	}
+
+	msg := &sqs.Message{MessageAttributes: map[string]*sqs.MessageAttributeValue{"log-format": attribute("xml")}}
+	if _, _, _, err := q.messageSettings(msg); err == nil {
+		t.Errorf("messageSettings(log-format=xml): expected error, actual nil")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// workerPool runs the receive, parse and delete workers of a queue. A
+// worker is one goroutine of each plus their heartbeats, so the pool can be
+// resized while it runs.
+type workerPool struct {
+	// oldestSent is the SentTimestamp, in milliseconds, of the oldest
+	// message received since the autoscaler last looked. It is accessed
+	// atomically, so it comes first to be 64-bit aligned.
+	oldestSent int64
+
+	d     metricClient
+	q     *queue
+	svc   sqsiface.SQSAPI
+	s3svc s3iface.S3API
+	wg    *sync.WaitGroup
+
+	messageStreamInput  chan *sqs.Message
+	deleteMessageStream chan *string
+	aliveParser         chan string
+	aliveDelete         chan string
+
+	mu    sync.Mutex
+	stops []chan struct{}
+}
+
+func newWorkerPool(d metricClient, q *queue, svc sqsiface.SQSAPI, s3svc s3iface.S3API, wg *sync.WaitGroup) *workerPool {
+	return &workerPool{
+		d:                   d,
+		q:                   q,
+		svc:                 svc,
+		s3svc:               s3svc,
+		wg:                  wg,
+		messageStreamInput:  make(chan *sqs.Message, config.ChannelBufferSize),
+		deleteMessageStream: make(chan *string, config.ChannelBufferSize),
+		aliveParser:         make(chan string),
+		aliveDelete:         make(chan string),
+	}
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stops)
+}
+
+// resize starts or stops workers until n are running. Stopped workers
+// finish what they are doing first, and the messages they leave in the
+// channels are handled by the remaining ones.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.stops) < n {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		p.wg.Add(5)
+		go receiveMessage(p.d, p.q, p.svc, p.messageStreamInput, p.wg, stop, p.observe)
+		go parseMessage(p.d, p.q, p.s3svc, p.messageStreamInput, p.deleteMessageStream, p.wg, p.aliveParser, stop)
+		go deleteMessage(p.d, p.q, p.svc, p.deleteMessageStream, p.wg, p.aliveDelete, stop)
+		go heartbeatParse(p.d, p.aliveParser, p.wg, stop)
+		go heartbeatDelete(p.d, p.aliveDelete, p.wg, stop)
+	}
+	for len(p.stops) > n {
+		close(p.stops[len(p.stops)-1])
+		p.stops = p.stops[:len(p.stops)-1]
+	}
+}
+
+// observe records the SentTimestamp of a received message.
+func (p *workerPool) observe(msg *sqs.Message) {
+	sent, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		oldest := atomic.LoadInt64(&p.oldestSent)
+		if oldest != 0 && oldest <= sent {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&p.oldestSent, oldest, sent) {
+			return
+		}
+	}
+}
+
+// oldestAge returns the age of the oldest message received since it was
+// last called, or zero when none was.
+func (p *workerPool) oldestAge(now time.Time) time.Duration {
+	sent := atomic.SwapInt64(&p.oldestSent, 0)
+	if sent == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, sent*int64(time.Millisecond)))
+}
+
+// autoscale resizes the pool between the queue's minimum and maximum number
+// of workers every interval, from the number of visible messages in the
+// queue and the age of the oldest message received. SQS only reports the
+// age of the oldest message to CloudWatch, so the age of the messages
+// workers receive is used instead.
+func (p *workerPool) autoscale(interval time.Duration) {
+	defer p.wg.Done()
+
+	params := &sqs.GetQueueAttributesInput{
+		QueueUrl:       &p.q.URL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+	}
+	tags := p.q.tags()
+	for range time.Tick(interval) {
+		resp, err := p.svc.GetQueueAttributes(params)
+		if err != nil {
+			log.Printf("get queue attributes error: %s\n%v", p.q.URL, err)
+			sendEvent(p.d, statsd.Event{
+				Title:     "get queue attributes error",
+				Text:      fmt.Sprintf("%s %v", p.q.URL, err),
+				AlertType: statsd.Error,
+			})
+			continue
+		}
+		visible, _ := strconv.ParseInt(aws.StringValue(resp.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]), 10, 64)
+		age := p.oldestAge(time.Now())
+
+		current := p.size()
+		desired := desiredWorkers(p.q, current, visible, age)
+		if desired != current {
+			direction := "up"
+			if desired < current {
+				direction = "down"
+			}
+			log.Printf("scale %s workers from %d to %d: %d visible messages, oldest received %s", p.q.Name, current, desired, visible, age)
+			p.resize(desired)
+			if err := p.d.Incr("receive_workers_scale", withTags(tags, createTag("direction", direction)), 1); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+
+		gauges := []struct {
+			name  string
+			value float64
+		}{
+			{"queue_visible_messages", float64(visible)},
+			{"queue_oldest_message_age", age.Seconds()},
+			{"receive_workers", float64(desired)},
+		}
+		for _, g := range gauges {
+			if err := p.d.Gauge(g.name, g.value, tags, 1); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
+
+// desiredWorkers returns the number of workers a queue needs: one per
+// SQS_AUTOSCALE_TARGET_MESSAGES visible messages, and one more than now when
+// messages wait longer than SQS_AUTOSCALE_MAX_AGE. The pool grows straight
+// to the number needed but shrinks one worker at a time, so a short lull
+// doesn't drop all the workers a backlog needs.
+func desiredWorkers(q *queue, current int, visible int64, age time.Duration) int {
+	target := config.SqsAutoscaleTargetMessages
+	if target < 1 {
+		target = 1
+	}
+	desired := int((visible + target - 1) / target)
+	maxAge := time.Duration(config.SqsAutoscaleMaxAge) * time.Second
+	if maxAge > 0 && age > maxAge && desired <= current {
+		desired = current + 1
+	}
+	if desired < current {
+		desired = current - 1
+	}
+	return clampInt(desired, q.MinGoRoutine, q.MaxGoRoutine)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
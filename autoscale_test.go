@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeSQS receives no messages.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+}
+
+func (f *fakeSQS) ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	time.Sleep(10 * time.Millisecond)
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func TestDesiredWorkers(t *testing.T) {
+	q := &queue{MinGoRoutine: 1, MaxGoRoutine: 8}
+
+	var data = []struct {
+		current  int
+		visible  int64
+		age      time.Duration
+		expected int
+	}{
+		{1, 0, 0, 1},
+		{4, 0, 0, 3},
+		{2, 150, 0, 2},
+		{1, 350, 0, 4},
+		{1, 100000, 0, 8},
+		{2, 10, time.Duration(config.SqsAutoscaleMaxAge+1) * time.Second, 3},
+		{8, 10, time.Duration(config.SqsAutoscaleMaxAge+1) * time.Second, 8},
+		{3, 1, time.Second, 2},
+	}
+
+	for _, tt := range data {
+		actual := desiredWorkers(q, tt.current, tt.visible, tt.age)
+		if actual != tt.expected {
+			t.Errorf("desiredWorkers(%d, %d, %s): expected %d, actual %d", tt.current, tt.visible, tt.age, tt.expected, actual)
+		}
+	}
+}
+
+func TestWorkerPoolOldestAge(t *testing.T) {
+	p := &workerPool{}
+	now := time.Unix(1578090901, 0)
+	if age := p.oldestAge(now); age != 0 {
+		t.Errorf("oldestAge(): expected 0, actual %s", age)
+	}
+	for _, sent := range []string{"1578090841000", "1578090781000", "not a timestamp", "1578090900000"} {
+		p.observe(&sqs.Message{Attributes: map[string]*string{"SentTimestamp": aws.String(sent)}})
+	}
+	if age := p.oldestAge(now); age != 2*time.Minute {
+		t.Errorf("oldestAge(): expected 2m0s, actual %s", age)
+	}
+	if age := p.oldestAge(now); age != 0 {
+		t.Errorf("oldestAge(): expected 0 after reset, actual %s", age)
+	}
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	var wg sync.WaitGroup
+	q := &queue{Name: "cdn", URL: "https://sqs.us-west-2.amazonaws.com/123456789012/cdn", Club: "test", Format: formatJSON}
+	p := newWorkerPool(&printClient{w: ioutil.Discard}, q, &fakeSQS{}, nil, &wg)
+
+	for _, n := range []int{3, 5, 1, 1} {
+		p.resize(n)
+		if actual := p.size(); actual != n {
+			t.Errorf("resize(%d): expected %d workers, actual %d", n, n, actual)
+		}
+	}
+
+	p.resize(0)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("resize(0): workers did not stop")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const backfillUsage = `usage: %s backfill -bucket BUCKET -distribution ID -start TIME -end TIME [flags]
+
+Backfill emits the metrics of the CloudFront standard log objects of a
+distribution logged between start (inclusive) and end (exclusive). Times are
+UTC and formatted as 2006-01-02T15 or 2006-01-02. Progress is recorded in a
+checkpoint file after every line, so running the same backfill again resumes
+where it left off rather than counting objects twice.
+
+Metrics are sent through DogStatsD, which timestamps them when it receives
+them: backfilled points land at the time the backfill runs, not at the hour
+they were logged. They carry a source:backfill tag to tell them apart.
+
+`
+
+// backfillDone is the checkpoint of an object that has been fully processed.
+// Otherwise the checkpoint is the number of lines processed.
+const backfillDone = "done"
+
+// backfill runs the backfill command and returns the process exit code.
+func backfill(args []string) int {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	bucket := fs.String("bucket", "", "bucket CloudFront writes standard logs to")
+	prefix := fs.String("prefix", "", "log prefix configured on the distribution, eg. \"cdn/\"")
+	dist := fs.String("distribution", "", "CloudFront distribution ID")
+	start := fs.String("start", "", "first hour to backfill")
+	end := fs.String("end", "", "hour to stop backfilling at")
+	region := fs.String("region", config.SqsRegion, "bucket region")
+	concurrency := fs.Int("concurrency", 4, "number of objects processed concurrently")
+	rate := fs.Float64("rate", 10, "maximum number of objects downloaded per second, 0 for no limit")
+	checkpointPath := fs.String("checkpoint", "", "checkpoint file, defaults to DISTRIBUTION.backfill.json")
+	dryRun := fs.Bool("dry-run", false, "print metrics to stdout instead of sending them to STATSD_HOST")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, backfillUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *bucket == "" || *dist == "" || *start == "" || *end == "" {
+		fs.Usage()
+		return 2
+	}
+	startTime, err := parseBackfillTime(*start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid start: %v\n", err)
+		return 2
+	}
+	endTime, err := parseBackfillTime(*end)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid end: %v\n", err)
+		return 2
+	}
+	if *checkpointPath == "" {
+		*checkpointPath = *dist + ".backfill.json"
+	}
+
+	var d metricClient
+	if *dryRun {
+		d = &printClient{w: os.Stdout, namespace: config.StatsdPrefix}
+	} else {
+		c, err := statsd.New(config.StatsdHost)
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		defer c.Close()
+		c.Namespace = config.StatsdPrefix
+		d = c
+	}
+
+	cp, err := newFileCheckpointer(*checkpointPath)
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	sess, err := session.NewSession(&aws.Config{Region: region})
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	svc := s3.New(sess)
+
+	keys, err := listLogObjects(svc, *bucket, *prefix, *dist, startTime, endTime)
+	if err != nil {
+		log.Printf("list log objects error: %v", err)
+		return 1
+	}
+	log.Printf("%s %d %s %s %s %s", "backfill", len(keys), "log objects from", *dist, startTime, endTime)
+
+	b := &backfiller{
+		d:      d,
+		svc:    svc,
+		cp:     cp,
+		bucket: *bucket,
+		tags:   withTags(defaultTags(), createTag("source", "backfill")),
+	}
+	if *rate > 0 {
+		b.limiter = time.Tick(time.Duration(float64(time.Second) / *rate))
+	}
+
+	// Stop gracefully on interrupt so every object's checkpoint is exact.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Printf("%s", "backfill interrupted, saving checkpoints")
+		b.stop()
+	}()
+
+	if failed := b.run(keys, *concurrency); failed > 0 {
+		log.Printf("%s %d %s", "backfill failed for", failed, "log objects, run it again to retry them")
+		return 1
+	}
+	if b.stopped() {
+		return 1
+	}
+	return 0
+}
+
+func parseBackfillTime(v string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not formatted as 2006-01-02T15 or 2006-01-02", v)
+}
+
+// logObjectTime returns the hour a CloudFront standard log object was
+// written for, from its DISTID.YYYY-MM-DD-HH.unique-ID.gz name.
+func logObjectTime(key, dist string) (time.Time, bool) {
+	parts := strings.Split(path.Base(key), ".")
+	if len(parts) < 3 || parts[0] != dist {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006-01-02-15", parts[1])
+	return t, err == nil
+}
+
+// listLogObjects returns the keys of a distribution's log objects written
+// for hours between start and end. It lists one day at a time so only the
+// range's objects are listed.
+func listLogObjects(svc s3iface.S3API, bucket, prefix, dist string, start, end time.Time) ([]string, error) {
+	var keys []string
+	for day := start.Truncate(24 * time.Hour); day.Before(end); day = day.Add(24 * time.Hour) {
+		err := svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix + dist + "." + day.Format("2006-01-02") + "-"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, o := range page.Contents {
+				key := aws.StringValue(o.Key)
+				t, ok := logObjectTime(key, dist)
+				if ok && !t.Before(start) && t.Before(end) {
+					keys = append(keys, key)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+type backfiller struct {
+	d       metricClient
+	svc     s3iface.S3API
+	cp      checkpointer
+	bucket  string
+	tags    []string
+	limiter <-chan time.Time
+
+	stopping int32
+}
+
+func (b *backfiller) stop() {
+	atomic.StoreInt32(&b.stopping, 1)
+}
+
+func (b *backfiller) stopped() bool {
+	return atomic.LoadInt32(&b.stopping) == 1
+}
+
+// run processes keys with concurrency workers and returns the number of
+// objects that failed.
+func (b *backfiller) run(keys []string, concurrency int) int {
+	var wg sync.WaitGroup
+	var failed int32
+	work := make(chan string)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				if b.stopped() {
+					continue
+				}
+				if err := b.processObject(key); err != nil {
+					atomic.AddInt32(&failed, 1)
+					log.Printf("backfill s3://%s/%s error: %v", b.bucket, key, err)
+				}
+			}
+		}()
+	}
+
+	for i, key := range keys {
+		if b.stopped() {
+			break
+		}
+		work <- key
+		if (i+1)%100 == 0 {
+			log.Printf("%s %d/%d", "backfill progress", i+1, len(keys))
+		}
+	}
+	close(work)
+	wg.Wait()
+	return int(failed)
+}
+
+// processObject emits the metrics of a log object, skipping the lines a
+// previous run already processed.
+func (b *backfiller) processObject(key string) error {
+	state, err := b.cp.checkpoint(key)
+	if err != nil {
+		return err
+	}
+	if state == backfillDone {
+		return nil
+	}
+	skip, _ := strconv.Atoi(state)
+
+	if b.limiter != nil {
+		<-b.limiter
+	}
+
+	line, processed := 0, skip
+	_, err = processS3Object(b.svc, s3Object{b.bucket, key}, func(raw logRecord) {
+		line++
+		if line <= skip || b.stopped() {
+			return
+		}
+		r := newRecord(raw)
+		emitMetrics(b.d, r, b.tags, nil, key)
+		r.release()
+		processed = line
+		// Every line is checkpointed, so a crash counts at most the line
+		// in flight twice.
+		if err := b.cp.setCheckpoint(key, strconv.Itoa(processed)); err != nil {
+			log.Printf("backfill checkpoint error: %s\n%v", key, err)
+		}
+	}, func(line string, err error) {
+		reportParseError(b.d, formatW3C, b.tags, line, err)
+	})
+	if err != nil || b.stopped() {
+		if cerr := b.cp.setCheckpoint(key, strconv.Itoa(processed)); cerr != nil {
+			log.Printf("backfill checkpoint error: %s\n%v", key, cerr)
+		}
+		return err
+	}
+
+	log.Printf("%s %d %s s3://%s/%s", "backfilled", processed-skip, "lines from", b.bucket, key)
+	return b.cp.setCheckpoint(key, backfillDone)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type fakeS3Bucket struct {
+	fakeS3
+	keys     []string
+	prefixes []string
+}
+
+func (f *fakeS3Bucket) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	prefix := aws.StringValue(in.Prefix)
+	f.prefixes = append(f.prefixes, prefix)
+	page := &s3.ListObjectsV2Output{}
+	for _, k := range f.keys {
+		if strings.HasPrefix(k, prefix) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(k)})
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func TestLogObjectTime(t *testing.T) {
+	var data = []struct {
+		key      string
+		expected time.Time
+		ok       bool
+	}{
+		{"cdn/E2ABC.2018-03-01-01.a1b2c3.gz", time.Date(2018, 3, 1, 1, 0, 0, 0, time.UTC), true},
+		{"E2ABC.2018-03-01-23.a1b2c3.gz", time.Date(2018, 3, 1, 23, 0, 0, 0, time.UTC), true},
+		{"cdn/E9XYZ.2018-03-01-01.a1b2c3.gz", time.Time{}, false},
+		{"cdn/E2ABC.2018-03-01.a1b2c3.gz", time.Time{}, false},
+	}
+
+	for _, tt := range data {
+		actual, ok := logObjectTime(tt.key, "E2ABC")
+		if ok != tt.ok || !actual.Equal(tt.expected) {
+			t.Errorf("logObjectTime(%s): expected %v %v, actual %v %v", tt.key, tt.expected, tt.ok, actual, ok)
+		}
+	}
+}
+
+func TestListLogObjects(t *testing.T) {
+	svc := &fakeS3Bucket{keys: []string{
+		"cdn/E2ABC.2018-02-28-23.a1.gz",
+		"cdn/E2ABC.2018-03-01-22.a1.gz",
+		"cdn/E2ABC.2018-03-01-23.a1.gz",
+		"cdn/E2ABC.2018-03-01-23.b2.gz",
+		"cdn/E2ABC.2018-03-02-00.a1.gz",
+		"cdn/E2ABC.2018-03-02-01.a1.gz",
+		"cdn/E9XYZ.2018-03-01-23.a1.gz",
+	}}
+	start := time.Date(2018, 3, 1, 23, 0, 0, 0, time.UTC)
+	end := time.Date(2018, 3, 2, 1, 0, 0, 0, time.UTC)
+
+	actual, err := listLogObjects(svc, "logs", "cdn/", "E2ABC", start, end)
+	if err != nil {
+		t.Fatalf("listLogObjects: unexpected error %v", err)
+	}
+	expected := []string{"cdn/E2ABC.2018-03-01-23.a1.gz", "cdn/E2ABC.2018-03-01-23.b2.gz", "cdn/E2ABC.2018-03-02-00.a1.gz"}
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Errorf("listLogObjects: expected %v, actual %v", expected, actual)
+	}
+	if diff := deep.Equal(svc.prefixes, []string{"cdn/E2ABC.2018-03-01-", "cdn/E2ABC.2018-03-02-"}); diff != nil {
+		t.Errorf("listLogObjects: unexpected prefixes %v", svc.prefixes)
+	}
+}
+
+func TestBackfillerProcessObject(t *testing.T) {
+	var gzbuf bytes.Buffer
+	gz := gzip.NewWriter(&gzbuf)
+	gz.Write([]byte(testLogFile))
+	gz.Close()
+
+	var data = []struct {
+		checkpoint string
+		expected   int
+	}{
+		{"", 2},
+		{"1", 1},
+		{backfillDone, 0},
+	}
+
+	for _, tt := range data {
+		var out bytes.Buffer
+		key := "cdn/E2ABC.2018-03-01-01.a1.gz"
+		cp := mapCheckpointer{key: tt.checkpoint}
+		b := &backfiller{
+			d:      &printClient{w: &out},
+			svc:    &fakeS3{body: gzbuf.Bytes()},
+			cp:     cp,
+			bucket: "logs",
+		}
+		if err := b.processObject(key); err != nil {
+			t.Errorf("processObject(%s): unexpected error %v", tt.checkpoint, err)
+		}
+		if actual := strings.Count(out.String(), "request:1|c"); actual != tt.expected {
+			t.Errorf("processObject(%s): expected %d records, actual %d", tt.checkpoint, tt.expected, actual)
+		}
+		if cp[key] != backfillDone {
+			t.Errorf("processObject(%s): expected checkpoint %s, actual %s", tt.checkpoint, backfillDone, cp[key])
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tagAllowlist is the names of the record tags a metric is sent with.
+// Names ending in * allow every tag starting with the rest, eg. edge_*.
+type tagAllowlist struct {
+	all      bool
+	names    map[string]bool
+	prefixes []string
+}
+
+func newTagAllowlist(names []string) *tagAllowlist {
+	a := &tagAllowlist{names: make(map[string]bool)}
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		switch {
+		case n == "*":
+			a.all = true
+		case strings.HasSuffix(n, "*"):
+			a.prefixes = append(a.prefixes, strings.TrimSuffix(n, "*"))
+		case n != "":
+			a.names[n] = true
+		}
+	}
+	return a
+}
+
+func (a *tagAllowlist) allows(name string) bool {
+	if a.all || a.names[name] {
+		return true
+	}
+	for _, p := range a.prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// metricAllowlists are the allowlists of the metrics sent per record, set
+// by METRIC_TAGS_REQUEST, METRIC_TAGS_RESULT_TYPE and
+// METRIC_TAGS_REQUEST_TIME.
+var metricAllowlists map[string]*tagAllowlist
+
+// tagName returns the name of a name:value tag.
+func tagName(tag string) string {
+	if i := strings.IndexByte(tag, ':'); i >= 0 {
+		return tag[:i]
+	}
+	return tag
+}
+
+// filterTags returns base followed by the tags the metric's allowlist
+// allows, in a buffer owned by r which the next call reuses.
+func (r *Record) filterTags(metric string, base, tags []string) []string {
+	a := metricAllowlists[metric]
+	filtered := append(r.metricBuf[:0], base...)
+	for _, tag := range tags {
+		if a.allows(tagName(tag)) {
+			filtered = append(filtered, tag)
+		}
+	}
+	r.metricBuf = filtered
+	return filtered
+}
+
+// limitTags folds the values of tags past their cardinality limit into
+// "other", in place. Tags no metric allows are left alone, so they don't
+// take up the limiter's memory.
+func limitTags(tags []string) {
+	for i, tag := range tags {
+		name := tagName(tag)
+		for _, a := range metricAllowlists {
+			if a.allows(name) {
+				tags[i] = tagLimiter.limit(name, tag)
+				break
+			}
+		}
+	}
+}
+
+// tagLimiter caps the cardinality of record tags, set by
+// TAG_CARDINALITY_LIMIT and TAG_CARDINALITY_LIMITS.
+var tagLimiter *cardinalityLimiter
+
+// cardinalityLimiter caps the number of distinct values every tag takes in
+// a window, since each value makes a time series of its own. Values seen
+// once the limit is reached are sent as "other" until the window ends.
+//
+// limit runs for every tag of every record, so values already seen and
+// values folded once the limit is reached are handled without locking. Only
+// adding a value locks, and only the tag's own values.
+type cardinalityLimiter struct {
+	// defaultLimit is the cap of tags without one of their own in limits.
+	defaultLimit int
+	limits       map[string]int
+	// values maps the name of every tag seen in the window to its
+	// *tagValues.
+	values sync.Map
+}
+
+// tagValues are the values a tag took in the window.
+type tagValues struct {
+	// count is how many tags seen holds, and folded how many tags were
+	// folded into other since the last report. Both are updated
+	// atomically, so they come first to be 64-bit aligned.
+	count  int64
+	folded int64
+	seen   sync.Map
+	// other is the tag values are folded into.
+	other string
+
+	// mu guards adding tags to seen.
+	mu sync.Mutex
+}
+
+func newCardinalityLimiter(limit int, limits map[string]int) *cardinalityLimiter {
+	return &cardinalityLimiter{
+		defaultLimit: limit,
+		limits:       limits,
+	}
+}
+
+// parseCardinalityLimits parses NAME=LIMIT rules.
+func parseCardinalityLimits(rules []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, v := range rules {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("cardinality limit %q is not TAG=LIMIT", v)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("cardinality limit %q has no positive limit", v)
+		}
+		limits[parts[0]] = n
+	}
+	return limits, nil
+}
+
+// limit returns tag, or name:other once the tag has reached its limit and
+// tag is a value it hasn't taken in the window.
+func (c *cardinalityLimiter) limit(name, tag string) string {
+	v, ok := c.values.Load(name)
+	if !ok {
+		v, _ = c.values.LoadOrStore(name, &tagValues{other: createTag(name, "other")})
+	}
+	values := v.(*tagValues)
+	if _, ok := values.seen.Load(tag); ok {
+		return tag
+	}
+	limit, ok := c.limits[name]
+	if !ok {
+		limit = c.defaultLimit
+	}
+	if atomic.LoadInt64(&values.count) >= int64(limit) {
+		atomic.AddInt64(&values.folded, 1)
+		return values.other
+	}
+	return values.add(tag, int64(limit))
+}
+
+// add adds tag to the values unless the limit was reached meanwhile.
+func (values *tagValues) add(tag string, limit int64) string {
+	values.mu.Lock()
+	defer values.mu.Unlock()
+	if _, ok := values.seen.Load(tag); ok {
+		return tag
+	}
+	if atomic.LoadInt64(&values.count) >= limit {
+		atomic.AddInt64(&values.folded, 1)
+		return values.other
+	}
+	// The tag is copied, since it may point into a whole message.
+	values.seen.Store(string(append([]byte(nil), tag...)), struct{}{})
+	atomic.AddInt64(&values.count, 1)
+	return tag
+}
+
+// tagCardinality is the cardinality of a tag in the window, and how many of
+// its tags were folded since the last report.
+type tagCardinality struct {
+	Name   string
+	Values int
+	Folded int64
+}
+
+// report returns the cardinality of every tag, sorted by name, and starts
+// a new window when reset is set.
+func (c *cardinalityLimiter) report(reset bool) []tagCardinality {
+	var report []tagCardinality
+	c.values.Range(func(name, v interface{}) bool {
+		values := v.(*tagValues)
+		report = append(report, tagCardinality{
+			Name:   name.(string),
+			Values: int(atomic.LoadInt64(&values.count)),
+			Folded: atomic.SwapInt64(&values.folded, 0),
+		})
+		if reset {
+			c.values.Delete(name)
+		}
+		return true
+	})
+	sort.Slice(report, func(i, j int) bool { return report[i].Name < report[j].Name })
+	return report
+}
+
+// reportCardinality sends the tag_cardinality gauge and tag_values_folded
+// count of every tag, tagged with its name, every
+// TAG_CARDINALITY_INTERVAL, and starts a new window every
+// TAG_CARDINALITY_WINDOW.
+func reportCardinality(d metricClient, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	window := time.Duration(config.TagCardinalityWindow) * time.Second
+	start := time.Now()
+	for now := range time.Tick(time.Duration(config.TagCardinalityInterval) * time.Second) {
+		reset := now.Sub(start) >= window
+		if reset {
+			start = now
+		}
+		for _, tc := range tagLimiter.report(reset) {
+			tags := withTags(defaultTags(), createTag("tag", tc.Name))
+			if err := d.Gauge("tag_cardinality", float64(tc.Values), tags, 1); err != nil {
+				log.Printf("%v", err)
+			}
+			if err := d.Count("tag_values_folded", tc.Folded, tags, 1); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
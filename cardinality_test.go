@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestFilterTags(t *testing.T) {
+	saved := metricAllowlists
+	defer func() { metricAllowlists = saved }()
+	metricAllowlists = map[string]*tagAllowlist{
+		"request":      newTagAllowlist([]string{"x_edge_location", " edge_*", ""}),
+		"request_time": newTagAllowlist([]string{"*"}),
+	}
+
+	r := &Record{}
+	tags := []string{"c_ip:192.0.2.1", "x_edge_location:SYD1", "edge_city:Sydney", "x_edge_request_id:abc"}
+	var data = []struct {
+		metric   string
+		expected []string
+	}{
+		{"request", []string{"club_name:dev", "x_edge_location:SYD1", "edge_city:Sydney"}},
+		{"request_time", append([]string{"club_name:dev"}, tags...)},
+	}
+	for _, tt := range data {
+		actual := r.filterTags(tt.metric, []string{"club_name:dev"}, tags)
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("filterTags(%s): expected %v, actual %v", tt.metric, tt.expected, actual)
+		}
+	}
+}
+
+func TestCardinalityLimiter(t *testing.T) {
+	savedAllowlists, savedLimiter := metricAllowlists, tagLimiter
+	defer func() { metricAllowlists, tagLimiter = savedAllowlists, savedLimiter }()
+	metricAllowlists = map[string]*tagAllowlist{"request": newTagAllowlist([]string{"cs_uri_stem", "sc_status"})}
+	limits, err := parseCardinalityLimits([]string{"cs_uri_stem=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagLimiter = newCardinalityLimiter(3, limits)
+
+	var actual [][]string
+	for _, stem := range []string{"/a", "/b", "/a", "/c", "/d", "/b"} {
+		tags := []string{createTag("cs_uri_stem", stem), "sc_status:200", createTag("c_ip", stem)}
+		limitTags(tags)
+		actual = append(actual, tags)
+	}
+	expected := [][]string{
+		{"cs_uri_stem:/a", "sc_status:200", "c_ip:/a"},
+		{"cs_uri_stem:/b", "sc_status:200", "c_ip:/b"},
+		{"cs_uri_stem:/a", "sc_status:200", "c_ip:/a"},
+		{"cs_uri_stem:other", "sc_status:200", "c_ip:/c"},
+		{"cs_uri_stem:other", "sc_status:200", "c_ip:/d"},
+		{"cs_uri_stem:/b", "sc_status:200", "c_ip:/b"},
+	}
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Errorf("limitTags: %v", diff)
+	}
+
+	// Tags no metric allows aren't tracked.
+	report := tagLimiter.report(true)
+	expectedReport := []tagCardinality{{Name: "cs_uri_stem", Values: 2, Folded: 2}, {Name: "sc_status", Values: 1}}
+	if diff := deep.Equal(report, expectedReport); diff != nil {
+		t.Errorf("report: expected %v, actual %v", expectedReport, report)
+	}
+	if tagLimiter.limit("cs_uri_stem", "cs_uri_stem:/c") != "cs_uri_stem:/c" {
+		t.Errorf("limit: expected a new window to admit new values")
+	}
+
+	// Concurrent records never take a tag past its limit.
+	tagLimiter = newCardinalityLimiter(10, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tagLimiter.limit("sc_status", "sc_status:"+strconv.Itoa(i*100+j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	report = tagLimiter.report(true)
+	expectedReport = []tagCardinality{{Name: "sc_status", Values: 10, Folded: 790}}
+	if diff := deep.Equal(report, expectedReport); diff != nil {
+		t.Errorf("report: expected %v, actual %v", expectedReport, report)
+	}
+
+	// Attribute tags are only sent with the metrics that allow them, and
+	// are limited like the record's own.
+	tagLimiter = newCardinalityLimiter(1, nil)
+	metricAllowlists = map[string]*tagAllowlist{
+		"request":      newTagAllowlist([]string{"distribution"}),
+		"result_type":  newTagAllowlist(nil),
+		"request_time": newTagAllowlist(nil),
+	}
+	var out bytes.Buffer
+	d := &printClient{w: &out}
+	for _, dist := range []string{"E1", "E2"} {
+		r := newJSONRecord(`{"x-edge-location":"SYD1"}`)
+		emitMetrics(d, r, []string{"club_name:dev"}, []string{"distribution:" + dist, "env:prod"}, "test")
+		r.release()
+	}
+	var requests []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(l, "request:") {
+			requests = append(requests, l)
+		}
+	}
+	expectedRequests := []string{"request:1|c|#club_name:dev,distribution:E1", "request:1|c|#club_name:dev,distribution:other"}
+	if diff := deep.Equal(requests, expectedRequests); diff != nil {
+		t.Errorf("emitMetrics: expected %v, actual %v", expectedRequests, requests)
+	}
+
+	for _, tt := range []string{"cs_uri_stem", "cs_uri_stem=0", "=5"} {
+		if _, err := parseCardinalityLimits([]string{tt}); err == nil {
+			t.Errorf("parseCardinalityLimits(%s): expected error, actual nil", tt)
+		}
+	}
+}
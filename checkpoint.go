@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// shardEnd is stored as the checkpoint of a shard that has been read to its
+// end after a reshard, so it is never read again.
+const shardEnd = "SHARD_END"
+
+// checkpointer remembers the last processed position per key, eg. the
+// sequence number per Kinesis shard, so a restart resumes where it left off.
+type checkpointer interface {
+	// checkpoint returns the stored position, or "" if there is none.
+	checkpoint(key string) (string, error)
+	setCheckpoint(key, value string) error
+}
+
+// newCheckpointer returns a DynamoDB checkpointer when table is set and a
+// file checkpointer when path is set.
+func newCheckpointer(sess *session.Session, path, table, namespace string) (checkpointer, error) {
+	switch {
+	case table != "":
+		return &dynamoCheckpointer{
+			svc:       dynamodb.New(sess),
+			table:     table,
+			namespace: namespace,
+		}, nil
+	case path != "":
+		return newFileCheckpointer(path)
+	}
+	return nil, fmt.Errorf("no checkpoint file or table configured for %s", namespace)
+}
+
+// fileCheckpointer keeps checkpoints in a local file, a log of JSON
+// checkpoint entries the last of which wins for each key. Updates are
+// appended, and the log is compacted when it is opened and once superseded
+// entries outnumber the current ones, so frequent updates stay cheap however
+// many keys there are. A file holding a single JSON object of checkpoints,
+// as written by earlier versions, is read and converted.
+type fileCheckpointer struct {
+	path string
+
+	mu          sync.Mutex
+	checkpoints map[string]string
+	f           *os.File
+	// entries is the number of entries in the log.
+	entries int
+}
+
+// checkpointEntry is a line of the checkpoint log.
+type checkpointEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func newFileCheckpointer(path string) (*fileCheckpointer, error) {
+	c := &fileCheckpointer{
+		path:        path,
+		checkpoints: make(map[string]string),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := c.load(b); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the checkpoints of a log. A final entry cut short by a crash
+// is ignored.
+func (c *fileCheckpointer) load(b []byte) error {
+	if len(b) > 0 && b[len(b)-1] != '\n' && json.Unmarshal(b, &c.checkpoints) == nil {
+		return nil
+	}
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var e checkpointEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+		c.checkpoints[e.Key] = e.Value
+	}
+	return nil
+}
+
+// compact atomically replaces the log with one entry per key and reopens it
+// for appending.
+func (c *fileCheckpointer) compact() error {
+	var buf bytes.Buffer
+	for k, v := range c.checkpoints {
+		b, err := json.Marshal(checkpointEntry{k, v})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if c.f != nil {
+		c.f.Close()
+	}
+	c.f, c.entries = f, len(c.checkpoints)
+	return nil
+}
+
+func (c *fileCheckpointer) checkpoint(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoints[key], nil
+}
+
+func (c *fileCheckpointer) setCheckpoint(key, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, err := json.Marshal(checkpointEntry{key, value})
+	if err != nil {
+		return err
+	}
+	if _, err := c.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	c.checkpoints[key] = value
+	c.entries++
+	if c.entries > 2*len(c.checkpoints)+1024 {
+		return c.compact()
+	}
+	return nil
+}
+
+// dynamoCheckpointer keeps checkpoints in a DynamoDB table with a string
+// hash key named "checkpoint_key". Keys are prefixed with a namespace, eg.
+// the stream name, so several collectors can share one table.
+type dynamoCheckpointer struct {
+	svc       dynamodbiface.DynamoDBAPI
+	table     string
+	namespace string
+}
+
+func (c *dynamoCheckpointer) key(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"checkpoint_key": {S: aws.String(c.namespace + "/" + key)},
+	}
+}
+
+func (c *dynamoCheckpointer) checkpoint(key string) (string, error) {
+	resp, err := c.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(c.table),
+		Key:            c.key(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if v, ok := resp.Item["checkpoint"]; ok {
+		return aws.StringValue(v.S), nil
+	}
+	return "", nil
+}
+
+func (c *dynamoCheckpointer) setCheckpoint(key, value string) error {
+	item := c.key(key)
+	item["checkpoint"] = &dynamodb.AttributeValue{S: aws.String(value)}
+	_, err := c.svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(c.table),
+		Item:      item,
+	})
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestFileCheckpointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints.json")
+
+	c, err := newFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("newFileCheckpointer: unexpected error %v", err)
+	}
+	if v, _ := c.checkpoint("shardId-000000000000"); v != "" {
+		t.Errorf("checkpoint: expected empty, actual %v", v)
+	}
+	if err := c.setCheckpoint("shardId-000000000000", "4959"); err != nil {
+		t.Fatalf("setCheckpoint: unexpected error %v", err)
+	}
+
+	// A new checkpointer must resume from the file.
+	c, err = newFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("newFileCheckpointer: unexpected error %v", err)
+	}
+	if v, _ := c.checkpoint("shardId-000000000000"); v != "4959" {
+		t.Errorf("checkpoint: expected 4959, actual %v", v)
+	}
+}
+
+func TestFileCheckpointerLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints.json")
+
+	var data = []struct {
+		file     string
+		expected map[string]string
+	}{
+		// A checkpoint file of an earlier version.
+		{`{"a":"1","b":"done"}`, map[string]string{"a": "1", "b": "done"}},
+		{"{\"key\":\"a\",\"value\":\"1\"}\n{\"key\":\"a\",\"value\":\"2\"}\n", map[string]string{"a": "2"}},
+		// An entry cut short by a crash.
+		{"{\"key\":\"a\",\"value\":\"1\"}\n{\"key\":\"a\",\"val", map[string]string{"a": "1"}},
+		{"", map[string]string{}},
+	}
+
+	for _, tt := range data {
+		if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := newFileCheckpointer(path)
+		if err != nil {
+			t.Errorf("newFileCheckpointer(%q): unexpected error %v", tt.file, err)
+			continue
+		}
+		if diff := deep.Equal(c.checkpoints, tt.expected); diff != nil {
+			t.Errorf("newFileCheckpointer(%q): expected %v, actual %v", tt.file, tt.expected, c.checkpoints)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{\"key\":\"a\"\n{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFileCheckpointer(path); err == nil {
+		t.Errorf("newFileCheckpointer: expected error for a corrupt entry")
+	}
+
+	// Updates are appended and compacted once superseded entries pile up.
+	os.Remove(path)
+	c, err := newFileCheckpointer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := c.setCheckpoint("key", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 64*1024 {
+		t.Errorf("setCheckpoint: expected a compacted log, actual %d bytes", fi.Size())
+	}
+	c, err = newFileCheckpointer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.checkpoint("key"); v != "4999" {
+		t.Errorf("checkpoint: expected 4999, actual %v", v)
+	}
+}
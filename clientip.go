@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const (
+	clientSourceCIP = "c-ip"
+	clientSourceXFF = "x-forwarded-for"
+)
+
+// privateNetworks are the networks that aren't routed on the internet,
+// which TRUSTED_PROXIES includes as "private".
+var privateNetworks = []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10"}
+
+// trustedProxies are the networks of the proxies, eg. corporate proxies or
+// other CDNs, whose X-Forwarded-For is believed, set by TRUSTED_PROXIES.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses CIDRs and addresses, where "private" stands for
+// the private networks.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range proxies {
+		v = strings.TrimSpace(v)
+		switch {
+		case v == "":
+			continue
+		case v == "private":
+			private, err := parseTrustedProxies(privateNetworks)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, private...)
+			continue
+		case !strings.Contains(v, "/"):
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR", v)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the address of the client that made a request and
+// where it came from. Proxies append the address that connected to them to
+// X-Forwarded-For, so the chain is followed from c-ip back through trusted
+// proxies, and the first address that isn't one is the client. Addresses
+// left of it could have been made up by the client, and a hop that isn't an
+// address ends the chain.
+func resolveClientIP(cip net.IP, xff string) (net.IP, string) {
+	if cip == nil && xff == "" {
+		return nil, ""
+	}
+	client, source := cip, clientSourceCIP
+	if cip != nil && !isTrustedProxy(cip) {
+		return client, source
+	}
+
+	if strings.Contains(xff, "%") {
+		if decoded, err := url.PathUnescape(xff); err == nil {
+			xff = decoded
+		}
+	}
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip := parseHop(hop)
+		if ip == nil {
+			break
+		}
+		client, source = ip, clientSourceXFF
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	if client == nil {
+		return nil, ""
+	}
+	return client, source
+}
+
+// parseHop parses an X-Forwarded-For address, which some proxies write
+// with a port.
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+var emptyClientTags = []string{createTag("client_ip_source", "")}
+
+// clientTags appends the client_ip_source tag of a record, followed by the
+// location and network tags of its client.
+func clientTags(r *Record, tags []string) []string {
+	if r.ClientSource == "" {
+		tags = append(tags, emptyClientTags...)
+	} else {
+		tags = r.tb.add(tags, "client_ip_source", r.ClientSource)
+	}
+	return geoTags(r, tags)
+}
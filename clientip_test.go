@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	var err error
+	if trustedProxies, err = parseTrustedProxies([]string{"private", "198.51.100.0/24", " 203.0.113.9"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var data = []struct {
+		cip            string
+		xff            string
+		expected       string
+		expectedSource string
+	}{
+		{"1.8.1.160", "", "1.8.1.160", "c-ip"},
+		// The viewer isn't a trusted proxy, so its X-Forwarded-For may be
+		// made up.
+		{"1.8.1.160", "203.0.113.7", "1.8.1.160", "c-ip"},
+		{"198.51.100.20", "203.0.113.7", "203.0.113.7", "x-forwarded-for"},
+		{"198.51.100.20", "1.1.1.1,%20203.0.113.7,%2010.0.0.1", "203.0.113.7", "x-forwarded-for"},
+		{"203.0.113.9", "1.1.1.1, 2001:db8::1, 198.51.100.7", "2001:db8::1", "x-forwarded-for"},
+		{"198.51.100.20", "192.0.2.1:51234", "192.0.2.1", "x-forwarded-for"},
+		{"198.51.100.20", "1.1.1.1, unknown, 10.0.0.1", "10.0.0.1", "x-forwarded-for"},
+		{"198.51.100.20", "10.0.0.2, 10.0.0.1,", "10.0.0.2", "x-forwarded-for"},
+		{"198.51.100.20", "", "198.51.100.20", "c-ip"},
+		{"", "203.0.113.7", "203.0.113.7", "x-forwarded-for"},
+		{"", "", "<nil>", ""},
+	}
+
+	for _, tt := range data {
+		actual, source := resolveClientIP(net.ParseIP(tt.cip), tt.xff)
+		if actual.String() != tt.expected || source != tt.expectedSource {
+			t.Errorf("resolveClientIP(%s, %s): expected %s from %s, actual %s from %s", tt.cip, tt.xff, tt.expected, tt.expectedSource, actual, source)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"192.0.2.1", "2001:db8::1", "10.0.0.0/8", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, n := range networks {
+		actual = append(actual, n.String())
+	}
+	expected := "[192.0.2.1/32 2001:db8::1/128 10.0.0.0/8]"
+	if s := fmt.Sprint(actual); s != expected {
+		t.Errorf("parseTrustedProxies: expected %s, actual %s", expected, s)
+	}
+	for _, tt := range []string{"10.0.0.0/33", "proxy.example.com"} {
+		if _, err := parseTrustedProxies([]string{tt}); err == nil {
+			t.Errorf("parseTrustedProxies(%s): expected error, actual nil", tt)
+		}
+	}
+}
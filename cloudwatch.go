@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// base64GzipPrefix is how every base64 encoded gzip stream starts, since
+// they all start with the same magic number and compression method.
+const base64GzipPrefix = "H4sI"
+
+// cloudWatchLogEvents decodes a CloudWatch Logs subscription payload, a gzip
+// compressed JSON document that is also base64 encoded when delivered as
+// text, eg. in an SQS message, or the document itself when the message
+// encoding was already decoded. It returns the message of every log event
+// and whether body is such a payload at all. Control messages, which
+// CloudWatch sends to check a destination is reachable, hold no log events.
+func cloudWatchLogEvents(body string) ([]string, bool) {
+	if strings.HasPrefix(body, base64GzipPrefix) {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(body))
+		if err != nil {
+			return nil, false
+		}
+		body = string(b)
+	}
+
+	var b []byte
+	switch {
+	case strings.HasPrefix(body, "\x1f\x8b"):
+		d, err := decode([]byte(body), encodingGzip)
+		if err != nil {
+			return nil, false
+		}
+		b = bytes.TrimSpace(d)
+	case looksJSON([]byte(body[:minInt(len(body), 64)])) && strings.Contains(body, `"logEvents"`):
+		b = []byte(strings.TrimSpace(body))
+	default:
+		return nil, false
+	}
+
+	if !isCloudWatchPayload(b) {
+		return nil, false
+	}
+	payload := gjson.ParseBytes(b)
+	if payload.Get("messageType").String() != "DATA_MESSAGE" {
+		return nil, true
+	}
+
+	var messages []string
+	for _, e := range payload.Get("logEvents").Array() {
+		messages = append(messages, e.Get("message").String())
+	}
+	return messages, true
+}
+
+// isCloudWatchPayload reports whether a decompressed document is a
+// CloudWatch Logs subscription payload.
+func isCloudWatchPayload(b []byte) bool {
+	payload := gjson.ParseBytes(b)
+	return payload.Get("messageType").String() != "" && payload.Get("logEvents").IsArray()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func gzipString(s string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.String()
+}
+
+func TestCloudWatchLogEvents(t *testing.T) {
+	data := `{"messageType":"DATA_MESSAGE","owner":"123456789012","logGroup":"/aws/cloudfront/edge","logStream":"SYD1","subscriptionFilters":["metrics"],"logEvents":[` +
+		`{"id":"1","timestamp":1519866123000,"message":"{\"x-edge-location\":\"SYD1\"}"},` +
+		`{"id":"2","timestamp":1519866124000,"message":"{\"x-edge-location\":\"MEL50\"}"}]}`
+	control := `{"messageType":"CONTROL_MESSAGE","owner":"CloudwatchLogs","logGroup":"","logStream":"","subscriptionFilters":[],"logEvents":[{"id":"","timestamp":1519866123000,"message":"CWL CONTROL MESSAGE: Checking health of destination"}]}`
+	messages := []string{`{"x-edge-location":"SYD1"}`, `{"x-edge-location":"MEL50"}`}
+
+	var tests = []struct {
+		name     string
+		body     string
+		expected []string
+		ok       bool
+	}{
+		{"gzip", gzipString(data), messages, true},
+		{"base64 gzip", base64.StdEncoding.EncodeToString([]byte(gzipString(data))), messages, true},
+		{"control message", gzipString(control), nil, true},
+		// Bodies whose encoding was decoded already, see decodeBody.
+		{"decoded", data, messages, true},
+		{"plain json", `{"x-edge-location":"SYD1","logEvents":"-"}`, nil, false},
+		{"other gzip json", gzipString(`{"x-edge-location":"SYD1"}`), nil, false},
+		{"invalid base64", base64GzipPrefix + "!!!", nil, false},
+		{"truncated gzip", gzipString(data)[:20], nil, false},
+	}
+
+	for _, tt := range tests {
+		actual, ok := cloudWatchLogEvents(tt.body)
+		if ok != tt.ok {
+			t.Errorf("cloudWatchLogEvents(%s): expected %v, actual %v", tt.name, tt.ok, ok)
+		}
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("cloudWatchLogEvents(%s): expected %v, actual %v", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseRecordsCloudWatch(t *testing.T) {
+	data := `{"messageType":"DATA_MESSAGE","logEvents":[{"id":"1","message":"{\"x-edge-location\":\"SYD1\"}"},{"id":"2","message":"[{\"x-edge-location\":\"MEL50\"},{\"x-edge-location\":\"SYD1\"}]"}]}`
+	body := base64.StdEncoding.EncodeToString([]byte(gzipString(data)))
+
+	// A queue with an explicit encoding hands parseRecords the decoded
+	// payload.
+	decoded, _, err := decodeBody(body, "gzip,base64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{body, decoded} {
+		var locations []string
+		err := parseRecords(&printClient{w: &bytes.Buffer{}}, nil, formatJSON, nil, b, func(r *Record, src interface{}) {
+			locations = append(locations, r.EdgeLocation)
+		})
+		if err != nil {
+			t.Fatalf("parseRecords: unexpected error %v", err)
+		}
+		if strings.Join(locations, ",") != "SYD1,MEL50,SYD1" {
+			t.Errorf("parseRecords: expected SYD1,MEL50,SYD1, actual %v", locations)
+		}
+	}
+}
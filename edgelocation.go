@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// edgeLocation is what we know about a CloudFront point of presence.
+type edgeLocation struct {
+	City      string
+	Country   string
+	Continent string
+	// Region is the CloudFront pricing region, which decides the cheapest
+	// price class that serves requests from the POP.
+	Region string
+
+	tags []string
+}
+
+// edgePriceClasses maps pricing regions to the cheapest price class that
+// includes them.
+var edgePriceClasses = map[string]string{
+	"north-america":      "100",
+	"europe":             "100",
+	"middle-east-africa": "200",
+	"japan":              "200",
+	"asia":               "200",
+	"india":              "200",
+	"south-america":      "all",
+	"australia":          "all",
+}
+
+// edgeLocationsCSV lists CloudFront POPs by the IATA airport code that
+// starts their x-edge-location, eg. SYD for SYD1 or SYD62-P1, as code, city,
+// ISO country code, continent code and pricing region. EDGE_LOCATIONS_FILE
+// adds or replaces POPs with lines of the same format.
+const edgeLocationsCSV = `ATL,Atlanta,US,NA,north-america
+AUS,Austin,US,NA,north-america
+BNA,Nashville,US,NA,north-america
+BOS,Boston,US,NA,north-america
+CLT,Charlotte,US,NA,north-america
+CMH,Columbus,US,NA,north-america
+DEN,Denver,US,NA,north-america
+DFW,Dallas,US,NA,north-america
+DTW,Detroit,US,NA,north-america
+EWR,Newark,US,NA,north-america
+HIO,Hillsboro,US,NA,north-america
+HNL,Honolulu,US,NA,north-america
+IAD,Ashburn,US,NA,north-america
+IAH,Houston,US,NA,north-america
+JAX,Jacksonville,US,NA,north-america
+JFK,New York,US,NA,north-america
+LAS,Las Vegas,US,NA,north-america
+LAX,Los Angeles,US,NA,north-america
+MCI,Kansas City,US,NA,north-america
+MIA,Miami,US,NA,north-america
+MSP,Minneapolis,US,NA,north-america
+OMA,Omaha,US,NA,north-america
+ORD,Chicago,US,NA,north-america
+PDX,Portland,US,NA,north-america
+PHL,Philadelphia,US,NA,north-america
+PHX,Phoenix,US,NA,north-america
+PIT,Pittsburgh,US,NA,north-america
+SEA,Seattle,US,NA,north-america
+SFO,San Francisco,US,NA,north-america
+SJC,San Jose,US,NA,north-america
+SLC,Salt Lake City,US,NA,north-america
+YTO,Toronto,CA,NA,north-america
+YUL,Montreal,CA,NA,north-america
+YVR,Vancouver,CA,NA,north-america
+YYC,Calgary,CA,NA,north-america
+MEX,Mexico City,MX,NA,north-america
+QRO,Queretaro,MX,NA,north-america
+AMS,Amsterdam,NL,EU,europe
+ARN,Stockholm,SE,EU,europe
+ATH,Athens,GR,EU,europe
+BCN,Barcelona,ES,EU,europe
+BER,Berlin,DE,EU,europe
+BRU,Brussels,BE,EU,europe
+BUD,Budapest,HU,EU,europe
+CDG,Paris,FR,EU,europe
+CPH,Copenhagen,DK,EU,europe
+DUB,Dublin,IE,EU,europe
+DUS,Dusseldorf,DE,EU,europe
+FCO,Rome,IT,EU,europe
+FRA,Frankfurt,DE,EU,europe
+HAM,Hamburg,DE,EU,europe
+HEL,Helsinki,FI,EU,europe
+LHR,London,GB,EU,europe
+LIS,Lisbon,PT,EU,europe
+MAD,Madrid,ES,EU,europe
+MAN,Manchester,GB,EU,europe
+MRS,Marseille,FR,EU,europe
+MUC,Munich,DE,EU,europe
+MXP,Milan,IT,EU,europe
+OSL,Oslo,NO,EU,europe
+OTP,Bucharest,RO,EU,europe
+PMO,Palermo,IT,EU,europe
+PRG,Prague,CZ,EU,europe
+SOF,Sofia,BG,EU,europe
+TXL,Berlin,DE,EU,europe
+VIE,Vienna,AT,EU,europe
+WAW,Warsaw,PL,EU,europe
+ZAG,Zagreb,HR,EU,europe
+ZRH,Zurich,CH,EU,europe
+TLV,Tel Aviv,IL,AS,europe
+BOG,Bogota,CO,SA,south-america
+EZE,Buenos Aires,AR,SA,south-america
+FOR,Fortaleza,BR,SA,south-america
+GIG,Rio de Janeiro,BR,SA,south-america
+GRU,Sao Paulo,BR,SA,south-america
+LIM,Lima,PE,SA,south-america
+SCL,Santiago,CL,SA,south-america
+CAI,Cairo,EG,AF,middle-east-africa
+CPT,Cape Town,ZA,AF,middle-east-africa
+JNB,Johannesburg,ZA,AF,middle-east-africa
+LOS,Lagos,NG,AF,middle-east-africa
+NBO,Nairobi,KE,AF,middle-east-africa
+BAH,Manama,BH,AS,middle-east-africa
+DOH,Doha,QA,AS,middle-east-africa
+DXB,Dubai,AE,AS,middle-east-africa
+FJR,Fujairah,AE,AS,middle-east-africa
+JED,Jeddah,SA,AS,middle-east-africa
+MCT,Muscat,OM,AS,middle-east-africa
+KIX,Osaka,JP,AS,japan
+NRT,Tokyo,JP,AS,japan
+BKK,Bangkok,TH,AS,asia
+CGK,Jakarta,ID,AS,asia
+GMP,Seoul,KR,AS,asia
+HAN,Hanoi,VN,AS,asia
+HKG,Hong Kong,HK,AS,asia
+ICN,Seoul,KR,AS,asia
+KUL,Kuala Lumpur,MY,AS,asia
+MNL,Manila,PH,AS,asia
+SGN,Ho Chi Minh City,VN,AS,asia
+SIN,Singapore,SG,AS,asia
+TPE,Taipei,TW,AS,asia
+BLR,Bangalore,IN,AS,india
+BOM,Mumbai,IN,AS,india
+CCU,Kolkata,IN,AS,india
+DEL,New Delhi,IN,AS,india
+HYD,Hyderabad,IN,AS,india
+MAA,Chennai,IN,AS,india
+AKL,Auckland,NZ,OC,australia
+BNE,Brisbane,AU,OC,australia
+MEL,Melbourne,AU,OC,australia
+PER,Perth,AU,OC,australia
+SYD,Sydney,AU,OC,australia
+`
+
+// edgeLocations are the known POPs by IATA code.
+var edgeLocations = func() map[string]*edgeLocation {
+	locations := make(map[string]*edgeLocation)
+	if err := readEdgeLocations(strings.NewReader(edgeLocationsCSV), locations); err != nil {
+		panic(err)
+	}
+	return locations
+}()
+
+var unknownEdgeLocation = newEdgeLocation("", "", "", "")
+
+// readEdgeLocations adds the POPs of a CSV table to locations.
+func readEdgeLocations(r io.Reader, locations map[string]*edgeLocation) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 5
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		code := strings.ToUpper(rec[0])
+		if len(code) != 3 {
+			return fmt.Errorf("edge location %q: expected a 3 letter IATA code", rec[0])
+		}
+		locations[code] = newEdgeLocation(rec[1], rec[2], rec[3], rec[4])
+	}
+}
+
+// loadEdgeLocations adds the POPs of EDGE_LOCATIONS_FILE to the built in
+// ones.
+func loadEdgeLocations(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := readEdgeLocations(f, edgeLocations); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	log.Printf("%s %s", "read edge locations from", path)
+	return nil
+}
+
+func newEdgeLocation(city, country, continent, region string) *edgeLocation {
+	return &edgeLocation{
+		City:      city,
+		Country:   country,
+		Continent: continent,
+		Region:    region,
+		tags: []string{
+			createTag("edge_city", city),
+			createTag("edge_country", country),
+			createTag("edge_continent", continent),
+			createTag("edge_region", region),
+			createTag("edge_price_class", edgePriceClasses[region]),
+		},
+	}
+}
+
+// edgeLocationCode returns the IATA code an x-edge-location starts with.
+func edgeLocationCode(location string) string {
+	if len(location) < 3 {
+		return ""
+	}
+	return strings.ToUpper(location[:3])
+}
+
+// lookupEdgeLocation returns the POP of an x-edge-location and whether it
+// is known.
+func lookupEdgeLocation(location string) (*edgeLocation, bool) {
+	if l, ok := edgeLocations[edgeLocationCode(location)]; ok {
+		return l, true
+	}
+	return unknownEdgeLocation, false
+}
+
+// edgeTags appends the edge_city, edge_country, edge_continent, edge_region
+// and edge_price_class tags of a record's POP.
+func edgeTags(r *Record, tags []string) []string {
+	l, _ := lookupEdgeLocation(r.EdgeLocation)
+	return append(tags, l.tags...)
+}
+
+// reportUnknownEdgeLocation counts records from POPs missing from the
+// table, tagged with their code, so they can be added to
+// EDGE_LOCATIONS_FILE.
+func reportUnknownEdgeLocation(d metricClient, r *Record, tags []string) {
+	if r.EdgeLocation == "" {
+		return
+	}
+	if _, ok := lookupEdgeLocation(r.EdgeLocation); ok {
+		return
+	}
+	if err := d.Incr("edge_location_unknown", withTags(tags, createTag("edge_code", edgeLocationCode(r.EdgeLocation))), 1); err != nil {
+		log.Printf("%v", err)
+	}
+}
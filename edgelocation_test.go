@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestEdgeLocations(t *testing.T) {
+	for code, l := range edgeLocations {
+		if _, ok := edgePriceClasses[l.Region]; !ok {
+			t.Errorf("edge location %s: unknown region %q", code, l.Region)
+		}
+		if len(l.Country) != 2 || len(l.Continent) != 2 {
+			t.Errorf("edge location %s: expected ISO country and continent codes, actual %q %q", code, l.Country, l.Continent)
+		}
+	}
+}
+
+func TestEdgeTags(t *testing.T) {
+	var data = []struct {
+		location string
+		expected []string
+	}{
+		{"SYD1", []string{"edge_city:Sydney", "edge_country:AU", "edge_continent:OC", "edge_region:australia", "edge_price_class:all"}},
+		{"IAD89-C1", []string{"edge_city:Ashburn", "edge_country:US", "edge_continent:NA", "edge_region:north-america", "edge_price_class:100"}},
+		{"fra56-p2", []string{"edge_city:Frankfurt", "edge_country:DE", "edge_continent:EU", "edge_region:europe", "edge_price_class:100"}},
+		{"XYZ1", []string{"edge_city:", "edge_country:", "edge_continent:", "edge_region:", "edge_price_class:"}},
+		{"", []string{"edge_city:", "edge_country:", "edge_continent:", "edge_region:", "edge_price_class:"}},
+	}
+
+	for _, tt := range data {
+		actual := edgeTags(&Record{EdgeLocation: tt.location}, nil)
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("edgeTags(%s): expected %v, actual %v", tt.location, tt.expected, actual)
+		}
+	}
+}
+
+func TestReportUnknownEdgeLocation(t *testing.T) {
+	var out bytes.Buffer
+	d := &printClient{w: &out}
+	for _, location := range []string{"SYD1", "", "XYZ1-C1"} {
+		reportUnknownEdgeLocation(d, &Record{EdgeLocation: location}, []string{"club_name:test"})
+	}
+	expected := "edge_location_unknown:1|c|#club_name:test,edge_code:XYZ\n"
+	if out.String() != expected {
+		t.Errorf("reportUnknownEdgeLocation: expected %q, actual %q", expected, out.String())
+	}
+}
+
+func TestLoadEdgeLocations(t *testing.T) {
+	f, err := ioutil.TempFile("", "edge-locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# overrides\nxyz, Somewhere, NZ, OC, australia\nSYD,Sydney Olympic Park,AU,OC,australia\n")
+	f.Close()
+
+	saved := make(map[string]*edgeLocation)
+	for k, v := range edgeLocations {
+		saved[k] = v
+	}
+	defer func() { edgeLocations = saved }()
+
+	if err := loadEdgeLocations(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	for code, city := range map[string]string{"XYZ1": "Somewhere", "SYD4": "Sydney Olympic Park", "MEL50": "Melbourne"} {
+		if l, ok := lookupEdgeLocation(code); !ok || l.City != city {
+			t.Errorf("lookupEdgeLocation(%s): expected %s, actual %s %v", code, city, l.City, ok)
+		}
+	}
+
+	if err := readEdgeLocations(bytes.NewBufferString("SYDN,Sydney,AU,OC,australia\n"), map[string]*edgeLocation{}); err == nil {
+		t.Errorf("readEdgeLocations: expected error for a 4 letter code")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Message body encodings. An encoding setting is either encodingAuto or a
+// comma separated list of encodings in the order they were applied, like an
+// HTTP Content-Encoding header, eg. "gzip,base64" for a gzip compressed body
+// that was then base64 encoded to fit in an SQS message.
+const (
+	encodingAuto   = "auto"
+	encodingNone   = "none"
+	encodingBase64 = "base64"
+	encodingGzip   = "gzip"
+	encodingZstd   = "zstd"
+)
+
+// maxDecodedBodySize limits the size of a decompressed message body.
+const maxDecodedBodySize = 64 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// parseEncodings returns the encodings listed in an encoding setting.
+func parseEncodings(v string) ([]string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" || v == encodingAuto || v == encodingNone {
+		return nil, nil
+	}
+	var encodings []string
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		switch e {
+		case encodingBase64, encodingGzip, encodingZstd:
+			encodings = append(encodings, e)
+		default:
+			return nil, fmt.Errorf("unknown encoding %q", e)
+		}
+	}
+	return encodings, nil
+}
+
+// messageEncoding returns the encoding of a message: the value of its
+// SQS_ENCODING_ATTRIBUTE_NAME attribute if set, otherwise the queue's.
+func messageEncoding(q *queue, msg *sqs.Message) string {
+	if a, ok := msg.MessageAttributes[config.SqsEncodingAttributeName]; ok && a.StringValue != nil {
+		return *a.StringValue
+	}
+	return q.Encoding
+}
+
+// decodeBody decodes a message body and returns the encodings it had, in
+// the order they were applied. With encodingAuto, base64, gzip and zstd
+// encodings are detected from the body itself.
+func decodeBody(body, encoding string) (string, []string, error) {
+	if strings.ToLower(strings.TrimSpace(encoding)) == encodingAuto || encoding == "" {
+		return detectAndDecode(body)
+	}
+	encodings, err := parseEncodings(encoding)
+	if err != nil {
+		return "", nil, err
+	}
+	b := []byte(body)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		if b, err = decode(b, encodings[i]); err != nil {
+			return "", nil, fmt.Errorf("%s: %v", encodings[i], err)
+		}
+	}
+	return string(b), encodings, nil
+}
+
+// detectAndDecode strips base64 and compression layers off a body until it
+// no longer looks encoded. A body is only taken as base64 when it decodes to
+// something encoded or to JSON, since a short plain text body can be valid
+// base64 too.
+func detectAndDecode(body string) (string, []string, error) {
+	b := []byte(body)
+	var encodings []string
+	for len(encodings) < 3 {
+		var e string
+		switch {
+		case bytes.HasPrefix(b, gzipMagic):
+			e = encodingGzip
+		case bytes.HasPrefix(b, zstdMagic):
+			e = encodingZstd
+		default:
+			if d, ok := base64Body(b); ok && (looksEncoded(d) || looksJSON(d)) {
+				b = d
+				encodings = append([]string{encodingBase64}, encodings...)
+				continue
+			}
+		}
+		if e == "" {
+			break
+		}
+		d, err := decode(b, e)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %v", e, err)
+		}
+		b = d
+		encodings = append([]string{e}, encodings...)
+	}
+	return string(b), encodings, nil
+}
+
+func decode(b []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case encodingBase64:
+		d, ok := base64Body(b)
+		if !ok {
+			return nil, errors.New("invalid base64 body")
+		}
+		return d, nil
+	case encodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return readDecoded(gz)
+	case encodingZstd:
+		// The decoder takes input too short for a frame header as empty.
+		if !bytes.HasPrefix(b, zstdMagic) {
+			return nil, errors.New("invalid zstd header")
+		}
+		zr, err := zstd.NewReader(bytes.NewReader(b), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxDecodedBodySize))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return readDecoded(zr)
+	}
+	return b, nil
+}
+
+// readDecoded reads a decompressed body of up to maxDecodedBodySize bytes.
+func readDecoded(r io.Reader) ([]byte, error) {
+	d, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(d) > maxDecodedBodySize {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", maxDecodedBodySize)
+	}
+	return d, nil
+}
+
+// base64Body decodes a standard or URL-safe base64 body.
+func base64Body(b []byte) ([]byte, bool) {
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return nil, false
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		if d, err := enc.DecodeString(s); err == nil {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+func looksEncoded(b []byte) bool {
+	return bytes.HasPrefix(b, gzipMagic) || bytes.HasPrefix(b, zstdMagic)
+}
+
+func looksJSON(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && (b[0] == '{' || b[0] == '[')
+}
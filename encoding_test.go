@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-test/deep"
+	"github.com/klauspost/compress/zstd"
+)
+
+func zstdString(s string) string {
+	enc, _ := zstd.NewWriter(nil)
+	defer enc.Close()
+	return string(enc.EncodeAll([]byte(s), nil))
+}
+
+func TestDecodeBody(t *testing.T) {
+	record := `{"x-edge-location":"SYD1","c-ip":"1.8.1.160"}`
+	gzipped := gzipString(record)
+	b64 := base64.StdEncoding.EncodeToString([]byte(gzipped))
+	zstded := zstdString(record)
+	cloudWatchPayload := `{"messageType":"DATA_MESSAGE","logEvents":[{"id":"1","message":"` + strings.Replace(record, `"`, `\"`, -1) + `"}]}`
+	cloudWatch := base64.StdEncoding.EncodeToString([]byte(gzipString(cloudWatchPayload)))
+
+	var data = []struct {
+		body      string
+		encoding  string
+		expected  string
+		encodings []string
+	}{
+		{record, encodingAuto, record, nil},
+		{"2019-12-04\t21:02:31\tLAX1-C3", encodingAuto, "2019-12-04\t21:02:31\tLAX1-C3", nil},
+		{"abcd", encodingAuto, "abcd", nil},
+		{gzipped, encodingAuto, record, []string{"gzip"}},
+		{b64, encodingAuto, record, []string{"gzip", "base64"}},
+		{base64.StdEncoding.EncodeToString([]byte(record)), encodingAuto, record, []string{"base64"}},
+		{base64.URLEncoding.EncodeToString([]byte(gzipped)), "", record, []string{"gzip", "base64"}},
+		{zstded, encodingAuto, record, []string{"zstd"}},
+		{base64.StdEncoding.EncodeToString([]byte(zstded)), encodingAuto, record, []string{"zstd", "base64"}},
+		{zstded, "zstd", record, []string{"zstd"}},
+		{cloudWatch, encodingAuto, cloudWatchPayload, []string{"gzip", "base64"}},
+		{cloudWatch, "gzip,base64", cloudWatchPayload, []string{"gzip", "base64"}},
+		{record, encodingNone, record, nil},
+		{b64, "gzip, base64", record, []string{"gzip", "base64"}},
+		{"abcd", "base64", "i\xb7\x1d", []string{"base64"}},
+	}
+
+	for _, tt := range data {
+		actual, encodings, err := decodeBody(tt.body, tt.encoding)
+		if err != nil {
+			t.Errorf("decodeBody(%q, %s): unexpected error %v", tt.body, tt.encoding, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("decodeBody(%q, %s): expected %q, actual %q", tt.body, tt.encoding, tt.expected, actual)
+		}
+		if diff := deep.Equal(encodings, tt.encodings); diff != nil {
+			t.Errorf("decodeBody(%q, %s): expected encodings %v, actual %v", tt.body, tt.encoding, tt.encodings, encodings)
+		}
+	}
+}
+
+func TestDecodeBodyErrors(t *testing.T) {
+	var data = []struct {
+		body     string
+		encoding string
+	}{
+		{"{}", "zstd"},
+		{"{}", "gzip"},
+		{zstdString("{}")[:6], encodingAuto},
+		{"not base64!", "base64"},
+		{"{}", "brotli"},
+		{gzipString("{}")[:12], encodingAuto},
+	}
+
+	for _, tt := range data {
+		if _, _, err := decodeBody(tt.body, tt.encoding); err == nil {
+			t.Errorf("decodeBody(%q, %s): expected error, actual nil", tt.body, tt.encoding)
+		}
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	record := `{"x-edge-location":"SYD1"}`
+	body := base64.StdEncoding.EncodeToString([]byte(gzipString(record)))
+	q := &queue{Name: "cdn", Club: "test", Encoding: encodingNone}
+	msg := &sqs.Message{
+		Body: aws.String(body),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			config.SqsEncodingAttributeName: {DataType: aws.String("String"), StringValue: aws.String("gzip,base64")},
+		},
+	}
+
+	var out bytes.Buffer
+	actual, err := decodeMessage(&printClient{w: &out}, q, msg)
+	if err != nil {
+		t.Fatalf("decodeMessage: unexpected error %v", err)
+	}
+	if actual != record {
+		t.Errorf("decodeMessage: expected %q, actual %q", record, actual)
+	}
+	expected := "message_encoded_bytes:" + strconv.Itoa(len(body)) + "|c|#club_name:test,queue:cdn,encoding:gzip+base64\n" +
+		"message_decoded_bytes:26|c|#club_name:test,queue:cdn,encoding:gzip+base64\n"
+	if out.String() != expected {
+		t.Errorf("decodeMessage: expected metrics %q, actual %q", expected, out.String())
+	}
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	large := strings.Repeat("a", maxDecodedBodySize+1)
+	for _, body := range []string{gzipString(large), zstdString(large)} {
+		if _, _, err := decodeBody(body, encodingAuto); err == nil || !strings.Contains(err.Error(), "exceeds") {
+			t.Errorf("decodeBody(%d bytes): expected size error, actual %v", len(body), err)
+		}
+	}
+}
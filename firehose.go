@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// firehoseRequest is the body Kinesis Data Firehose delivers to an HTTP
+// endpoint. Each record's data is base64 encoded.
+type firehoseRequest struct {
+	RequestID string `json:"requestId"`
+	Timestamp int64  `json:"timestamp"`
+	Records   []struct {
+		Data string `json:"data"`
+	} `json:"records"`
+}
+
+// firehoseResponse acknowledges a delivery. Firehose retries the delivery
+// unless it receives a 200 response echoing the request id.
+type firehoseResponse struct {
+	RequestID    string `json:"requestId"`
+	Timestamp    int64  `json:"timestamp"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+type firehoseHandler struct {
+	d           metricClient
+	s3svc       s3iface.S3API
+	accessKey   string
+	format      string
+	tags        []string
+	maxBodySize int64
+}
+
+func serveFirehose(d metricClient, s3svc s3iface.S3API, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	h := &firehoseHandler{
+		d:           d,
+		s3svc:       s3svc,
+		accessKey:   config.FirehoseAccessKey,
+		format:      config.FirehoseRecordFormat,
+		tags:        defaultTags(),
+		maxBodySize: config.FirehoseMaxBodySize,
+	}
+	log.Fatal(http.ListenAndServe(config.FirehoseListenAddr, h))
+}
+
+func (h *firehoseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := r.Header.Get("X-Amz-Firehose-Request-Id")
+
+	if r.Method != http.MethodPost {
+		h.respond(w, http.StatusMethodNotAllowed, requestID, "method not allowed")
+		return
+	}
+	if h.accessKey != "" {
+		key := r.Header.Get("X-Amz-Firehose-Access-Key")
+		if key == "" {
+			h.respond(w, http.StatusUnauthorized, requestID, "missing access key")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(h.accessKey)) != 1 {
+			h.respond(w, http.StatusForbidden, requestID, "invalid access key")
+			return
+		}
+	}
+
+	if r.ContentLength > h.maxBodySize {
+		h.respond(w, http.StatusRequestEntityTooLarge, requestID, "request body too large")
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			h.respond(w, http.StatusBadRequest, requestID, err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// The size limit applies to the decompressed body too, so a small gzip
+	// body can't expand into an arbitrarily large delivery.
+	b, err := ioutil.ReadAll(io.LimitReader(body, h.maxBodySize+1))
+	if err != nil {
+		h.respond(w, http.StatusBadRequest, requestID, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if int64(len(b)) > h.maxBodySize {
+		h.respond(w, http.StatusRequestEntityTooLarge, requestID, "request body too large")
+		return
+	}
+
+	var req firehoseRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		h.respond(w, http.StatusBadRequest, requestID, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if requestID == "" {
+		requestID = req.RequestID
+	}
+
+	// Decode every record before processing any so a malformed delivery is
+	// rejected as a whole rather than partially counted.
+	records := make([]string, len(req.Records))
+	for i, rec := range req.Records {
+		b, err := base64.StdEncoding.DecodeString(rec.Data)
+		if err != nil {
+			h.respond(w, http.StatusBadRequest, requestID, fmt.Sprintf("record %d: %v", i, err))
+			return
+		}
+		records[i] = string(b)
+	}
+
+	// Records that can't be parsed are counted and skipped by
+	// processMessage, so an error is one worth retrying, eg. an S3 object
+	// that couldn't be fetched. Firehose retries the whole delivery, which
+	// counts the records already processed again, but that beats losing the
+	// failed ones.
+	failed := 0
+	for i, rec := range records {
+		if err := processMessage(h.d, h.s3svc, h.format, h.tags, rec); err != nil {
+			log.Printf("process firehose record error: %s %d\n%v", requestID, i, err)
+			sendEvent(h.d, statsd.Event{
+				Title:     "process firehose record error",
+				Text:      fmt.Sprintf("%s %d %v", requestID, i, err),
+				AlertType: statsd.Error,
+			})
+			failed++
+		}
+	}
+	if failed > 0 {
+		h.respond(w, http.StatusInternalServerError, requestID, fmt.Sprintf("%d of %d records failed", failed, len(records)))
+		return
+	}
+	log.Printf("%s %d %s %s", "process", len(records), "firehose records from request", requestID)
+	h.respond(w, http.StatusOK, requestID, "")
+}
+
+func (h *firehoseHandler) respond(w http.ResponseWriter, status int, requestID, errorMessage string) {
+	if errorMessage != "" {
+		log.Printf("firehose request error: %s %d %s", requestID, status, errorMessage)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(firehoseResponse{
+		RequestID:    requestID,
+		Timestamp:    time.Now().UnixNano() / int64(time.Millisecond),
+		ErrorMessage: errorMessage,
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+)
+
+func TestFirehoseHandler(t *testing.T) {
+	d, err := statsd.New(config.StatsdHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &firehoseHandler{
+		d:           d,
+		accessKey:   "secret",
+		format:      formatJSON,
+		maxBodySize: 1024,
+	}
+	record := base64.StdEncoding.EncodeToString([]byte(`{"x-edge-location":"SYD1","c-ip":"1.8.1.160","time-taken":"1.14"}`))
+
+	var data = []struct {
+		method    string
+		accessKey string
+		body      string
+		expected  int
+	}{
+		{"POST", "secret", `{"requestId":"r1","timestamp":1578090901599,"records":[{"data":"` + record + `"}]}`, http.StatusOK},
+		{"POST", "secret", `{"requestId":"r1","timestamp":1578090901599,"records":[]}`, http.StatusOK},
+		{"POST", "", `{"requestId":"r1","records":[]}`, http.StatusUnauthorized},
+		{"POST", "wrong", `{"requestId":"r1","records":[]}`, http.StatusForbidden},
+		{"POST", "secret", `{"requestId":"r1","records":[{"data":"not base64!"}]}`, http.StatusBadRequest},
+		{"POST", "secret", `{"requestId":`, http.StatusBadRequest},
+		{"POST", "secret", `{"requestId":"r1","records":[{"data":"` + strings.Repeat("A", 2048) + `"}]}`, http.StatusRequestEntityTooLarge},
+		{"GET", "secret", ``, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range data {
+		req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		req.Header.Set("X-Amz-Firehose-Request-Id", "r1")
+		if tt.accessKey != "" {
+			req.Header.Set("X-Amz-Firehose-Access-Key", tt.accessKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.expected {
+			t.Errorf("ServeHTTP(%s %s): expected %d, actual %d", tt.method, tt.body, tt.expected, w.Code)
+		}
+		var resp firehoseResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.RequestID != "r1" || resp.Timestamp == 0 {
+			t.Errorf("ServeHTTP(%s %s): unexpected response %s", tt.method, tt.body, w.Body.String())
+		}
+	}
+}
+
+func TestFirehoseHandlerRecordError(t *testing.T) {
+	d, err := statsd.New(config.StatsdHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &firehoseHandler{
+		d:           d,
+		format:      formatS3,
+		maxBodySize: 1024,
+	}
+	// The second record can't be processed, so the delivery is retried.
+	event := base64.StdEncoding.EncodeToString([]byte(`{"Records":[]}`))
+	invalid := base64.StdEncoding.EncodeToString([]byte(`not an event`))
+	body := `{"requestId":"r1","records":[{"data":"` + event + `"},{"data":"` + invalid + `"}]}`
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("ServeHTTP(%s): expected %d, actual %d", body, http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestFirehoseHandlerGzipLimit(t *testing.T) {
+	h := &firehoseHandler{
+		d:           nopClient{},
+		format:      formatJSON,
+		maxBodySize: 1024,
+	}
+	// A small gzip body that decompresses beyond the limit is rejected.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"requestId":"r1","records":[{"data":"` + strings.Repeat("A", 4096) + `"}]}`))
+	gz.Close()
+
+	req := httptest.NewRequest("POST", "/", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("ServeHTTP(gzip %d bytes): expected %d, actual %d", buf.Len(), http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
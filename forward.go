@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// forwardServer implements the Fluentd Forward protocol, so fluentd's
+// out_forward can deliver records to the collector directly. Every entry,
+// whichever of the Message, Forward, PackedForward or CompressedPackedForward
+// modes it is sent in, is processed like an SQS message body holding its
+// records, and acknowledged once processed when fluentd asks for an ack.
+type forwardServer struct {
+	d     metricClient
+	s3svc s3iface.S3API
+	// format is the format records are processed in. JSON records are the
+	// whole fluentd record, any other format is read from messageKey, eg.
+	// the "message" key of in_tail's none parser.
+	format     string
+	messageKey string
+	tags       []string
+	maxSize    int
+}
+
+func serveForward(d metricClient, s3svc s3iface.S3API, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	s := &forwardServer{
+		d:          d,
+		s3svc:      s3svc,
+		format:     config.ForwardRecordFormat,
+		messageKey: config.ForwardMessageKey,
+		tags:       defaultTags(),
+		maxSize:    config.ForwardMaxChunkSize,
+	}
+	ln, err := net.Listen("tcp", config.ForwardListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("accept forward connection error: %v", err)
+			continue
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn handles the entries fluentd sends over a connection until it is
+// closed. A malformed entry closes the connection, since the stream can't be
+// resynchronised. An entry that fails to process isn't acknowledged, so
+// fluentd retries its chunk.
+func (s *forwardServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	dec := newMsgpackDecoder(bufio.NewReader(conn), s.maxSize)
+	for {
+		v, err := dec.decode()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("read forward entry error: %s\n%v", conn.RemoteAddr(), err)
+			return
+		}
+
+		records, option, err := s.entryRecords(v)
+		if err != nil {
+			log.Printf("read forward entry error: %s\n%v", conn.RemoteAddr(), err)
+			return
+		}
+		body := s.messageBody(records)
+		if body == "" {
+			log.Printf("forward entry has no records: %s", conn.RemoteAddr())
+		} else if err := processMessage(s.d, s.s3svc, s.format, s.tags, body); err != nil {
+			log.Printf("process forward entry error: %s\n%v", conn.RemoteAddr(), err)
+			sendEvent(s.d, statsd.Event{
+				Title:     "process forward entry error",
+				Text:      fmt.Sprintf("%s %v", conn.RemoteAddr(), err),
+				AlertType: statsd.Error,
+			})
+			continue
+		}
+
+		if chunk, ok := option["chunk"].(string); ok && chunk != "" {
+			ack := append([]byte{0x81}, msgpackString("ack")...)
+			if _, err := conn.Write(append(ack, msgpackString(chunk)...)); err != nil {
+				log.Printf("write forward ack error: %s\n%v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// entryRecords returns the records of a Forward protocol entry and its
+// option, telling the modes apart by the type of the entry's second element:
+// a time for Message, an array for Forward and a binary or string holding a
+// MessagePack stream for PackedForward and CompressedPackedForward.
+func (s *forwardServer) entryRecords(v interface{}) ([]map[string]interface{}, map[string]interface{}, error) {
+	entry, ok := v.([]interface{})
+	if !ok || len(entry) < 2 {
+		return nil, nil, errors.New("forward entry is not an array")
+	}
+	if _, ok := entry[0].(string); !ok {
+		return nil, nil, errors.New("forward entry has no tag")
+	}
+
+	var records []map[string]interface{}
+	var option map[string]interface{}
+	switch events := entry[1].(type) {
+	case []interface{}:
+		if len(entry) > 2 {
+			option, _ = entry[2].(map[string]interface{})
+		}
+		for _, e := range events {
+			r, err := forwardEventRecord(e)
+			if err != nil {
+				return nil, nil, err
+			}
+			records = append(records, r)
+		}
+	case string, []byte:
+		if len(entry) > 2 {
+			option, _ = entry[2].(map[string]interface{})
+		}
+		var stream io.Reader
+		if b, ok := events.([]byte); ok {
+			stream = bytes.NewReader(b)
+		} else {
+			stream = strings.NewReader(events.(string))
+		}
+		if option["compressed"] == "gzip" {
+			gz, err := gzip.NewReader(stream)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer gz.Close()
+			stream = io.LimitReader(gz, int64(s.maxSize))
+		}
+		dec := newMsgpackDecoder(stream, s.maxSize)
+		for {
+			e, err := dec.decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			r, err := forwardEventRecord(e)
+			if err != nil {
+				return nil, nil, err
+			}
+			records = append(records, r)
+		}
+	default:
+		if len(entry) < 3 {
+			return nil, nil, errors.New("forward message has no record")
+		}
+		if len(entry) > 3 {
+			option, _ = entry[3].(map[string]interface{})
+		}
+		r, ok := entry[2].(map[string]interface{})
+		if !ok {
+			return nil, nil, errors.New("forward record is not a map")
+		}
+		records = append(records, r)
+	}
+	return records, option, nil
+}
+
+// forwardEventRecord returns the record of a [time, record] event.
+func forwardEventRecord(v interface{}) (map[string]interface{}, error) {
+	e, ok := v.([]interface{})
+	if !ok || len(e) != 2 {
+		return nil, errors.New("forward event is not a [time, record] array")
+	}
+	r, ok := e[1].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("forward record is not a map")
+	}
+	return r, nil
+}
+
+// messageBody turns records into a message body of the server's format, one
+// record per line.
+func (s *forwardServer) messageBody(records []map[string]interface{}) string {
+	lines := make([]string, 0, len(records))
+	for _, r := range records {
+		if s.format == formatJSON {
+			b, err := json.Marshal(jsonValue(r))
+			if err != nil {
+				log.Printf("encode forward record error: %v", err)
+				continue
+			}
+			lines = append(lines, string(b))
+			continue
+		}
+		switch msg := r[s.messageKey].(type) {
+		case string:
+			lines = append(lines, msg)
+		case []byte:
+			lines = append(lines, string(msg))
+		default:
+			log.Printf("forward record has no %s key: %v", s.messageKey, r)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// jsonValue converts the binaries in a decoded MessagePack value to strings,
+// since fluentd sends strings as binaries when their encoding is unknown.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = jsonValue(v[k])
+		}
+	}
+	return v
+}
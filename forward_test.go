@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestForwardEntryRecords(t *testing.T) {
+	s := &forwardServer{maxSize: 1024}
+	eventTime := msgpackExt{Type: 0, Data: []byte{0x5e, 0x10, 0x3c, 0x95, 0x00, 0x00, 0x00, 0x00}}
+	r1 := map[string]interface{}{"x-edge-location": "SYD1"}
+	r2 := map[string]interface{}{"x-edge-location": "LAX1"}
+	packed := append(msgpackEncode([]interface{}{1578090901, r1}), msgpackEncode([]interface{}{eventTime, r2})...)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(packed)
+	gz.Close()
+	option := map[string]interface{}{"chunk": "c1"}
+
+	var data = []struct {
+		mode     string
+		entry    []interface{}
+		expected []map[string]interface{}
+		option   map[string]interface{}
+	}{
+		{"Message", []interface{}{"cloudfront", 1578090901, r1}, []map[string]interface{}{r1}, nil},
+		{"Message", []interface{}{"cloudfront", eventTime, r1, option}, []map[string]interface{}{r1}, option},
+		{"Forward", []interface{}{"cloudfront", []interface{}{[]interface{}{1578090901, r1}, []interface{}{eventTime, r2}}, option}, []map[string]interface{}{r1, r2}, option},
+		{"PackedForward", []interface{}{"cloudfront", packed}, []map[string]interface{}{r1, r2}, nil},
+		{"PackedForward", []interface{}{"cloudfront", string(packed)}, []map[string]interface{}{r1, r2}, nil},
+		{"CompressedPackedForward", []interface{}{"cloudfront", compressed.Bytes(), map[string]interface{}{"compressed": "gzip"}}, []map[string]interface{}{r1, r2}, map[string]interface{}{"compressed": "gzip"}},
+	}
+
+	for _, tt := range data {
+		v, err := newMsgpackDecoder(bytes.NewReader(msgpackEncode(tt.entry)), 1024).decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, option, err := s.entryRecords(v)
+		if err != nil {
+			t.Errorf("entryRecords(%s): unexpected error %v", tt.mode, err)
+			continue
+		}
+		if diff := deep.Equal(records, tt.expected); diff != nil {
+			t.Errorf("entryRecords(%s): expected %v, actual %v", tt.mode, tt.expected, records)
+		}
+		if diff := deep.Equal(option, tt.option); diff != nil {
+			t.Errorf("entryRecords(%s): expected option %v, actual %v", tt.mode, tt.option, option)
+		}
+	}
+}
+
+func TestForwardMessageBody(t *testing.T) {
+	records := []map[string]interface{}{
+		{"x-edge-location": "SYD1", "c-ip": []byte("1.8.1.160")},
+		{"message": "1578090901.599\t1.8.1.160\t0.001"},
+	}
+
+	var data = []struct {
+		format   string
+		expected string
+	}{
+		{formatJSON, `{"c-ip":"1.8.1.160","x-edge-location":"SYD1"}` + "\n" + `{"message":"1578090901.599\t1.8.1.160\t0.001"}`},
+		{formatRealtime, "1578090901.599\t1.8.1.160\t0.001"},
+	}
+
+	for _, tt := range data {
+		s := &forwardServer{format: tt.format, messageKey: "message"}
+		actual := s.messageBody(records)
+		if actual != tt.expected {
+			t.Errorf("messageBody(%s): expected %q, actual %q", tt.format, tt.expected, actual)
+		}
+	}
+}
+
+func TestForwardServeConn(t *testing.T) {
+	s := &forwardServer{
+		d:          &printClient{w: ioutil.Discard},
+		format:     formatJSON,
+		messageKey: "message",
+		tags:       defaultTags(),
+		maxSize:    1024,
+	}
+	client, server := net.Pipe()
+	go s.serveConn(server)
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	record := map[string]interface{}{"x-edge-location": "SYD1", "c-ip": "1.8.1.160", "time-taken": "1.14"}
+	entry := []interface{}{"cloudfront", []interface{}{[]interface{}{1578090901, record}}, map[string]interface{}{"chunk": "p8n9gmxTQVC8/nh2wlKKeQ=="}}
+	if _, err := client.Write(msgpackEncode(entry)); err != nil {
+		t.Fatal(err)
+	}
+
+	ack, err := newMsgpackDecoder(client, 1024).decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"ack": "p8n9gmxTQVC8/nh2wlKKeQ=="}
+	if diff := deep.Equal(ack, expected); diff != nil {
+		t.Errorf("serveConn(): expected %v, actual %v", expected, ack)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// geoCacheSize is how many database records keep their tags cached. The
+// cache is emptied when it is full, which is cheaper than tracking use for
+// what is mostly a few thousand networks.
+const geoCacheSize = 100000
+
+// geoDB is a MaxMind database file, which is read again whenever it changes
+// on disk, eg. when geoipupdate replaces it.
+type geoDB struct {
+	path string
+	// tags decodes the database record at offset into tags, and empty are
+	// the tags of addresses the database has no record for.
+	tags  func(r *maxminddb.Reader, offset uintptr) ([]string, error)
+	empty []string
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+	info   os.FileInfo
+	// cache holds the tags of records by their offset in the database, since
+	// many addresses share a record.
+	cache map[uintptr][]string
+}
+
+// geoCity and geoASN enrich metrics with the location and network of the
+// client when GEOIP_CITY_DB and GEOIP_ASN_DB are set.
+var geoCity, geoASN *geoDB
+
+func openGeoDB(path string, tags func(r *maxminddb.Reader, offset uintptr) ([]string, error), empty []string) (*geoDB, error) {
+	db := &geoDB{path: path, tags: tags, empty: empty}
+	if _, err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reload reads the database again when its size or modification time
+// changed, and reports whether it did. The database in use is kept when the
+// new one can't be read.
+func (db *geoDB) reload() (bool, error) {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	unchanged := db.info != nil && fi.Size() == db.info.Size() && fi.ModTime().Equal(db.info.ModTime())
+	db.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// The database is read into memory rather than mapped, so replacing the
+	// file can't affect lookups still using the previous reader.
+	b, err := ioutil.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", db.path, err)
+	}
+	db.mu.Lock()
+	db.reader, db.info, db.cache = r, fi, make(map[uintptr][]string)
+	db.mu.Unlock()
+	return true, nil
+}
+
+// lookup returns the tags of ip.
+func (db *geoDB) lookup(ip net.IP) []string {
+	if ip == nil {
+		return db.empty
+	}
+	db.mu.RLock()
+	r := db.reader
+	offset, err := r.LookupOffset(ip)
+	if err != nil || offset == maxminddb.NotFound {
+		db.mu.RUnlock()
+		return db.empty
+	}
+	tags, ok := db.cache[offset]
+	db.mu.RUnlock()
+	if ok {
+		return tags
+	}
+
+	tags, err = db.tags(r, offset)
+	if err != nil {
+		tags = db.empty
+	}
+	db.mu.Lock()
+	// The database may have been reloaded meanwhile.
+	if db.reader == r {
+		if len(db.cache) >= geoCacheSize {
+			db.cache = make(map[uintptr][]string)
+		}
+		db.cache[offset] = tags
+	}
+	db.mu.Unlock()
+	return tags
+}
+
+// cityRecord is the part of a GeoIP2 or GeoLite2 City or Country record the
+// tags are made of.
+type cityRecord struct {
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+var emptyCityTags = cityRecord{}.tags()
+
+func cityTags(r *maxminddb.Reader, offset uintptr) ([]string, error) {
+	var rec cityRecord
+	if err := r.Decode(offset, &rec); err != nil {
+		return nil, err
+	}
+	return rec.tags(), nil
+}
+
+// tags returns the client_country, client_region and client_continent tags.
+// Regions are ISO 3166-2 codes, eg. AU-NSW.
+func (rec cityRecord) tags() []string {
+	country := rec.Country.ISOCode
+	if country == "" {
+		// Anycast and satellite networks only have the country they are
+		// registered in.
+		country = rec.RegisteredCountry.ISOCode
+	}
+	region := ""
+	if len(rec.Subdivisions) > 0 && rec.Subdivisions[0].ISOCode != "" && country != "" {
+		region = country + "-" + rec.Subdivisions[0].ISOCode
+	}
+	return []string{
+		createTag("client_country", country),
+		createTag("client_region", region),
+		createTag("client_continent", rec.Continent.Code),
+	}
+}
+
+// asnRecord is a GeoIP2 or GeoLite2 ASN record.
+type asnRecord struct {
+	AutonomousSystemNumber       uint64 `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+var emptyASNTags = asnRecord{}.tags()
+
+func asnTags(r *maxminddb.Reader, offset uintptr) ([]string, error) {
+	var rec asnRecord
+	if err := r.Decode(offset, &rec); err != nil {
+		return nil, err
+	}
+	return rec.tags(), nil
+}
+
+// tags returns the client_asn and client_as_org tags.
+func (rec asnRecord) tags() []string {
+	asn := ""
+	if rec.AutonomousSystemNumber != 0 {
+		asn = strconv.FormatUint(rec.AutonomousSystemNumber, 10)
+	}
+	return []string{
+		createTag("client_asn", asn),
+		createTag("client_as_org", tagValue(rec.AutonomousSystemOrganization)),
+	}
+}
+
+// tagValue replaces the characters that separate tags and metric fields in
+// the dogstatsd format, eg. the comma in "Amazon.com, Inc.".
+func tagValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#':
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// openGeoIP opens the configured GeoIP databases.
+func openGeoIP() error {
+	var err error
+	if config.GeoIPCityDB != "" {
+		if geoCity, err = openGeoDB(config.GeoIPCityDB, cityTags, emptyCityTags); err != nil {
+			return err
+		}
+		log.Printf("%s %s", "enrich metrics with client locations from", config.GeoIPCityDB)
+	}
+	if config.GeoIPASNDB != "" {
+		if geoASN, err = openGeoDB(config.GeoIPASNDB, asnTags, emptyASNTags); err != nil {
+			return err
+		}
+		log.Printf("%s %s", "enrich metrics with client networks from", config.GeoIPASNDB)
+	}
+	return nil
+}
+
+// reloadGeoIP checks every GEOIP_RELOAD_INTERVAL whether the GeoIP databases
+// changed on disk and reads them again if they did.
+func reloadGeoIP(d metricClient, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for range time.Tick(time.Duration(config.GeoIPReloadInterval) * time.Second) {
+		for _, db := range []*geoDB{geoCity, geoASN} {
+			if db == nil {
+				continue
+			}
+			reloaded, err := db.reload()
+			if err != nil {
+				log.Printf("reload GeoIP database error: %s\n%v", db.path, err)
+				sendEvent(d, statsd.Event{
+					Title:     "reload GeoIP database error",
+					Text:      fmt.Sprintf("%s %v", db.path, err),
+					AlertType: statsd.Error,
+				})
+				continue
+			}
+			if reloaded {
+				log.Printf("%s %s", "reloaded GeoIP database", db.path)
+			}
+		}
+	}
+}
+
+// geoTags appends the location and network tags of the client of a record.
+func geoTags(r *Record, tags []string) []string {
+	if geoCity == nil && geoASN == nil {
+		return tags
+	}
+	if geoCity != nil {
+		tags = append(tags, geoCity.lookup(r.Client)...)
+	}
+	if geoASN != nil {
+		tags = append(tags, geoASN.lookup(r.Client)...)
+	}
+	return tags
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// The MaxMind DB data types written by mmdbEncode.
+const (
+	mmdbString = 2
+	mmdbUint16 = 5
+	mmdbUint32 = 6
+	mmdbMap    = 7
+	mmdbArray  = 11
+)
+
+// mmdbNetwork is a network and its record for buildMMDB.
+type mmdbNetwork struct {
+	cidr   string
+	record interface{}
+}
+
+// buildMMDB writes an IPv6 MaxMind DB with 24 bit records holding networks,
+// with IPv4 networks mapped to ::/96 like MaxMind's databases. See
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+func buildMMDB(t testing.TB, dbType string, networks []mmdbNetwork) []byte {
+	// Children are 0 when empty, a node index, or -(i+1) for the record of
+	// networks[i]. The root is never a child.
+	nodes := [][2]int{{}}
+	for i, n := range networks {
+		ip, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		if ip4 := ip.To4(); ip4 != nil {
+			ones += 96
+			ip = append(make(net.IP, 12), ip4...)
+		}
+		node := 0
+		for b := 0; b < ones; b++ {
+			bit := int(ip[b/8]>>(7-uint(b%8))) & 1
+			if b == ones-1 {
+				nodes[node][bit] = -(i + 1)
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(networks))
+	for i, n := range networks {
+		offsets[i] = data.Len()
+		data.Write(mmdbEncode(n.record))
+	}
+
+	var out bytes.Buffer
+	for _, children := range nodes {
+		var records [2]uint32
+		for bit, c := range children {
+			switch {
+			case c == 0:
+				records[bit] = uint32(len(nodes))
+			case c > 0:
+				records[bit] = uint32(c)
+			default:
+				records[bit] = uint32(len(nodes) + 16 + offsets[-c-1])
+			}
+		}
+		l, r := records[0], records[1]
+		out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.Write(mmdbMetadataMarker)
+	out.Write(mmdbEncode(map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(6),
+		"database_type":               dbType,
+		"binary_format_major_version": uint16(2),
+	}))
+	return out.Bytes()
+}
+
+// mmdbEncode encodes a value in the MaxMind DB data format.
+func mmdbEncode(v interface{}) []byte {
+	var b bytes.Buffer
+	switch v := v.(type) {
+	case string:
+		mmdbControl(&b, mmdbString, len(v))
+		b.WriteString(v)
+	case uint16:
+		mmdbUintBytes(&b, mmdbUint16, uint64(v))
+	case uint32:
+		mmdbUintBytes(&b, mmdbUint32, uint64(v))
+	case []interface{}:
+		mmdbControl(&b, mmdbArray, len(v))
+		for _, e := range v {
+			b.Write(mmdbEncode(e))
+		}
+	case map[string]interface{}:
+		mmdbControl(&b, mmdbMap, len(v))
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.Write(mmdbEncode(k))
+			b.Write(mmdbEncode(v[k]))
+		}
+	}
+	return b.Bytes()
+}
+
+func mmdbUintBytes(b *bytes.Buffer, typ int, v uint64) {
+	var buf []byte
+	for ; v > 0; v >>= 8 {
+		buf = append([]byte{byte(v)}, buf...)
+	}
+	mmdbControl(b, typ, len(buf))
+	b.Write(buf)
+}
+
+func mmdbControl(b *bytes.Buffer, typ, size int) {
+	ctrl := byte(typ << 5)
+	if typ > 7 {
+		ctrl = 0
+	}
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		sizeBytes = []byte{byte((size - 285) >> 8), byte(size - 285)}
+	default:
+		ctrl |= 31
+		size -= 65821
+		sizeBytes = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+	}
+	b.WriteByte(ctrl)
+	if typ > 7 {
+		b.WriteByte(byte(typ - 7))
+	}
+	b.Write(sizeBytes)
+}
+
+func writeGeoDB(t *testing.T, path, dbType string, networks []mmdbNetwork) {
+	if err := ioutil.WriteFile(path, buildMMDB(t, dbType, networks), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cityPath, asnPath := filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb")
+	writeGeoDB(t, cityPath, "GeoLite2-City", []mmdbNetwork{
+		{"1.8.1.0/24", map[string]interface{}{
+			"continent":    map[string]interface{}{"code": "OC"},
+			"country":      map[string]interface{}{"iso_code": "AU"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "NSW"}},
+		}},
+		{"2001:db8::/32", map[string]interface{}{
+			"continent":          map[string]interface{}{"code": "EU"},
+			"registered_country": map[string]interface{}{"iso_code": "DE"},
+		}},
+	})
+	writeGeoDB(t, asnPath, "GeoLite2-ASN", []mmdbNetwork{
+		{"1.8.0.0/16", map[string]interface{}{"autonomous_system_number": uint32(16509), "autonomous_system_organization": "Amazon.com, Inc."}},
+	})
+
+	defer func() { geoCity, geoASN = nil, nil }()
+	if geoCity, err = openGeoDB(cityPath, cityTags, emptyCityTags); err != nil {
+		t.Fatal(err)
+	}
+	if geoASN, err = openGeoDB(asnPath, asnTags, emptyASNTags); err != nil {
+		t.Fatal(err)
+	}
+
+	var data = []struct {
+		r        *Record
+		expected []string
+	}{
+		{&Record{Client: net.ParseIP("1.8.1.160")}, []string{"client_country:AU", "client_region:AU-NSW", "client_continent:OC", "client_asn:16509", "client_as_org:Amazon.com_ Inc."}},
+		{&Record{Client: net.ParseIP("1.8.2.1")}, []string{"client_country:", "client_region:", "client_continent:", "client_asn:16509", "client_as_org:Amazon.com_ Inc."}},
+		{&Record{Client: net.ParseIP("2001:db8::1")}, []string{"client_country:DE", "client_region:", "client_continent:EU", "client_asn:", "client_as_org:"}},
+		{&Record{}, []string{"client_country:", "client_region:", "client_continent:", "client_asn:", "client_as_org:"}},
+	}
+	for _, tt := range data {
+		actual := geoTags(tt.r, nil)
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("geoTags(%s): expected %v, actual %v", tt.r.Client, tt.expected, actual)
+		}
+	}
+
+	// A replaced database is read again, a broken one is not.
+	writeGeoDB(t, asnPath, "GeoLite2-ASN", []mmdbNetwork{
+		{"1.8.0.0/16", map[string]interface{}{"autonomous_system_number": uint32(4826)}},
+	})
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(asnPath, future, future)
+	if reloaded, err := geoASN.reload(); !reloaded || err != nil {
+		t.Errorf("reload: expected reload, actual %v %v", reloaded, err)
+	}
+	if reloaded, err := geoASN.reload(); reloaded || err != nil {
+		t.Errorf("reload: expected no reload, actual %v %v", reloaded, err)
+	}
+	ioutil.WriteFile(asnPath, []byte("truncated"), 0644)
+	if _, err := geoASN.reload(); err == nil {
+		t.Errorf("reload: expected error")
+	}
+	expected := []string{"client_asn:4826", "client_as_org:"}
+	if actual := geoASN.lookup(net.ParseIP("1.8.1.160")); deep.Equal(actual, expected) != nil {
+		t.Errorf("lookup: expected %v, actual %v", expected, actual)
+	}
+}
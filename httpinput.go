@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// httpInputEnqueueTimeout is how long a request waits for room in the parse
+// channel before the shipper is told to retry later.
+const httpInputEnqueueTimeout = 10 * time.Second
+
+// httpInputHandler accepts batches of records POSTed by log shippers and
+// puts them on the channel the HTTP input's own parseMessage goroutines read
+// from, like receiveMessage does with SQS messages. The message body is a JSON record, a JSON array or
+// newline delimited JSON, optionally gzip encoded.
+type httpInputHandler struct {
+	token              string
+	maxBodySize        int64
+	messageStreamInput chan<- *sqs.Message
+}
+
+// startHTTPInput starts the parse pipeline of the HTTP input and its
+// listener. Messages from the HTTP input have no receipt handle, so nothing
+// is ever sent to the delete stream.
+func startHTTPInput(d metricClient, s3svc s3iface.S3API, wg *sync.WaitGroup) {
+	q := &queue{
+		Name:      "http",
+		Club:      config.Club,
+		Format:    formatJSON,
+		GoRoutine: config.GoRoutine,
+	}
+	messageStreamInput := make(chan *sqs.Message, config.ChannelBufferSize)
+	deleteMessageStream := make(chan *string)
+	aliveParser := make(chan string)
+	for i := 0; i < q.GoRoutine; i++ {
+		wg.Add(2)
+		go parseMessage(d, q, s3svc, messageStreamInput, deleteMessageStream, wg, aliveParser, nil)
+		go heartbeatParse(d, aliveParser, wg, nil)
+	}
+
+	if config.HTTPInputToken == "" {
+		log.Printf("%s\n", "HTTP_INPUT_ALLOW_UNAUTHENTICATED is set, the HTTP input accepts unauthenticated requests")
+	}
+	h := &httpInputHandler{
+		token:              config.HTTPInputToken,
+		maxBodySize:        config.HTTPInputMaxBodySize,
+		messageStreamInput: messageStreamInput,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		log.Fatal(http.ListenAndServe(config.HTTPInputListenAddr, h))
+	}()
+}
+
+func (h *httpInputHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(h.token)) != 1 {
+			http.Error(w, "invalid bearer token", http.StatusForbidden)
+			return
+		}
+	}
+	if r.ContentLength > h.maxBodySize {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// The size limit applies to the decompressed body too, so a small gzip
+	// body can't expand into an arbitrarily large message.
+	b, err := ioutil.ReadAll(io.LimitReader(body, h.maxBodySize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if int64(len(b)) > h.maxBodySize {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	msg := string(b)
+	select {
+	case h.messageStreamInput <- &sqs.Message{Body: &msg}:
+		w.WriteHeader(http.StatusAccepted)
+	case <-time.After(httpInputEnqueueTimeout):
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+	}
+}
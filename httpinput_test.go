@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestHTTPInputHandler(t *testing.T) {
+	record := `{"x-edge-location":"SYD1","c-ip":"1.8.1.160","time-taken":"1.14"}`
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	io.WriteString(gz, record+"\n"+record)
+	gz.Close()
+	var bomb bytes.Buffer
+	gz = gzip.NewWriter(&bomb)
+	io.WriteString(gz, strings.Repeat(" ", 4096))
+	gz.Close()
+
+	var data = []struct {
+		method   string
+		token    string
+		encoding string
+		body     string
+		expected int
+		message  string
+	}{
+		{"POST", "secret", "", record, http.StatusAccepted, record},
+		{"POST", "secret", "", "[" + record + "," + record + "]", http.StatusAccepted, "[" + record + "," + record + "]"},
+		{"POST", "secret", "gzip", gzipped.String(), http.StatusAccepted, record + "\n" + record},
+		{"POST", "secret", "", "\n", http.StatusAccepted, ""},
+		{"POST", "", "", record, http.StatusUnauthorized, ""},
+		{"POST", "wrong", "", record, http.StatusForbidden, ""},
+		{"POST", "secret", "gzip", record, http.StatusBadRequest, ""},
+		{"POST", "secret", "", strings.Repeat("A", 2048), http.StatusRequestEntityTooLarge, ""},
+		{"POST", "secret", "gzip", bomb.String(), http.StatusRequestEntityTooLarge, ""},
+		{"GET", "secret", "", "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tt := range data {
+		ch := make(chan *sqs.Message, 1)
+		h := &httpInputHandler{
+			token:              "secret",
+			maxBodySize:        1024,
+			messageStreamInput: ch,
+		}
+		req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.expected {
+			t.Errorf("ServeHTTP(%s %q): expected %d, actual %d", tt.method, tt.body, tt.expected, w.Code)
+		}
+		var message string
+		select {
+		case msg := <-ch:
+			if msg.ReceiptHandle != nil {
+				t.Errorf("ServeHTTP(%s %q): unexpected receipt handle", tt.method, tt.body)
+			}
+			message = *msg.Body
+		default:
+		}
+		if message != tt.message {
+			t.Errorf("ServeHTTP(%s %q): expected message %q, actual %q", tt.method, tt.body, tt.message, message)
+		}
+	}
+}
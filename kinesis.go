@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// defaultRealtimeLogFields is the order CloudFront writes real-time log
+// fields in when every field is selected. It must match the field list of
+// the real-time log configuration, otherwise set REALTIME_LOG_FIELDS.
+var defaultRealtimeLogFields = []string{
+	"timestamp",
+	"c-ip",
+	"time-to-first-byte",
+	"sc-status",
+	"sc-bytes",
+	"cs-method",
+	"cs-protocol",
+	"cs-host",
+	"cs-uri-stem",
+	"cs-bytes",
+	"x-edge-location",
+	"x-edge-request-id",
+	"x-host-header",
+	"time-taken",
+	"cs-protocol-version",
+	"c-ip-version",
+	"cs-user-agent",
+	"cs-referer",
+	"cs-cookie",
+	"cs-uri-query",
+	"x-edge-response-result-type",
+	"x-forwarded-for",
+	"ssl-protocol",
+	"ssl-cipher",
+	"x-edge-result-type",
+	"fle-encrypted-fields",
+	"fle-status",
+	"sc-content-type",
+	"sc-content-len",
+	"sc-range-start",
+	"sc-range-end",
+	"c-port",
+	"x-edge-detailed-result-type",
+	"c-country",
+	"cs-accept-encoding",
+	"cs-accept",
+	"cache-behavior-path-pattern",
+	"cs-headers",
+	"cs-header-names",
+	"cs-headers-count",
+}
+
+// realtimeLogFields returns the configured real-time log field list.
+func realtimeLogFields() []string {
+	if len(config.RealtimeLogFields) == 0 {
+		return defaultRealtimeLogFields
+	}
+	return config.RealtimeLogFields
+}
+
+// realtimeFieldNames maps real-time log field names to the standard log
+// field names used by the rest of the pipeline.
+var realtimeFieldNames = map[string]string{
+	"cs-host":       "cs(Host)",
+	"cs-user-agent": "cs(User-Agent)",
+	"cs-referer":    "cs(Referer)",
+	"cs-cookie":     "cs(Cookie)",
+}
+
+// realtimeRecord parses a single CloudFront real-time log record. Fields are
+// tab separated in the order of the real-time log configuration. The epoch
+// timestamp is also split into the standard log's date and time fields.
+func realtimeRecord(fields []string, line string) (logRecord, error) {
+	values := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields, actual %d", len(fields), len(values))
+	}
+
+	r := make(logRecord, len(fields)+2)
+	for i, f := range fields {
+		if n, ok := realtimeFieldNames[f]; ok {
+			f = n
+		}
+		if f == "timestamp" {
+			ts, err := strconv.ParseFloat(values[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("timestamp: invalid number %q", values[i])
+			}
+			t := time.Unix(0, int64(ts*float64(time.Second))).UTC()
+			r["date"] = t.Format("2006-01-02")
+			r["time"] = t.Format("15:04:05")
+		}
+		r[f] = w3cValue(f, values[i])
+	}
+	return r, nil
+}
+
+type shardStart struct {
+	ShardID      string
+	IteratorType string
+	// SequenceNumber is set when resuming from a checkpoint, and Timestamp
+	// when resuming AT_TIMESTAMP.
+	SequenceNumber string
+	Timestamp      time.Time
+}
+
+// readyShards decides which of the stream's shards should be read now.
+// Closed shards are skipped, and a shard created by a reshard is only read
+// once its parents have been read to their end so records are processed in
+// order. A child shard starts at TRIM_HORIZON so nothing is lost between
+// the parent's last record and the child's first.
+func readyShards(shards []*kinesis.Shard, cp checkpointer, running map[string]bool, initialPosition string) ([]shardStart, error) {
+	known := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		known[aws.StringValue(s.ShardId)] = true
+	}
+
+	var ready []shardStart
+	for _, s := range shards {
+		id := aws.StringValue(s.ShardId)
+		if running[id] {
+			continue
+		}
+		seq, err := cp.checkpoint(id)
+		if err != nil {
+			return nil, err
+		}
+		if seq == shardEnd {
+			continue
+		}
+		if seq != "" {
+			ready = append(ready, shardStart{ShardID: id, IteratorType: kinesis.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: seq})
+			continue
+		}
+
+		iteratorType := initialPosition
+		parentsDone := true
+		for _, parent := range []*string{s.ParentShardId, s.AdjacentParentShardId} {
+			// Parents that are no longer part of the stream have expired
+			// with the retention period.
+			if parent == nil || !known[*parent] {
+				continue
+			}
+			iteratorType = kinesis.ShardIteratorTypeTrimHorizon
+			pseq, err := cp.checkpoint(*parent)
+			if err != nil {
+				return nil, err
+			}
+			if pseq != shardEnd {
+				parentsDone = false
+			}
+		}
+		if parentsDone {
+			ready = append(ready, shardStart{ShardID: id, IteratorType: iteratorType})
+		}
+	}
+	return ready, nil
+}
+
+type kinesisConsumer struct {
+	d      metricClient
+	svc    kinesisiface.KinesisAPI
+	s3svc  s3iface.S3API
+	cp     checkpointer
+	stream string
+	format string
+	tags   []string
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newKinesisConsumer(d metricClient, svc kinesisiface.KinesisAPI, s3svc s3iface.S3API, cp checkpointer) *kinesisConsumer {
+	return &kinesisConsumer{
+		d:       d,
+		svc:     svc,
+		s3svc:   s3svc,
+		cp:      cp,
+		stream:  config.KinesisStreamName,
+		format:  config.KinesisRecordFormat,
+		tags:    defaultTags(),
+		running: make(map[string]bool),
+	}
+}
+
+// run reads every shard of the stream, periodically looking for new shards
+// created by resharding. It never returns.
+func (c *kinesisConsumer) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		if err := c.syncShards(); err != nil {
+			log.Printf("kinesis sync shards error: %s\n%v", c.stream, err)
+			sendEvent(c.d, statsd.Event{
+				Title:     "kinesis sync shards error",
+				Text:      fmt.Sprintf("%s %v", c.stream, err),
+				AlertType: statsd.Error,
+			})
+		}
+		time.Sleep(time.Duration(config.KinesisShardSyncInterval) * time.Second)
+	}
+}
+
+func (c *kinesisConsumer) syncShards() error {
+	var shards []*kinesis.Shard
+	err := c.svc.DescribeStreamPages(&kinesis.DescribeStreamInput{
+		StreamName: aws.String(c.stream),
+	}, func(page *kinesis.DescribeStreamOutput, lastPage bool) bool {
+		shards = append(shards, page.StreamDescription.Shards...)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ready, err := readyShards(shards, c.cp, c.running, config.KinesisInitialPosition)
+	if err != nil {
+		return err
+	}
+	for _, s := range ready {
+		log.Printf("%s %s %s %s", "start reading kinesis shard", c.stream, s.ShardID, s.IteratorType)
+		c.running[s.ShardID] = true
+		go c.consumeShard(s)
+	}
+	return nil
+}
+
+func (c *kinesisConsumer) shardIterator(s shardStart) (*string, error) {
+	params := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(c.stream),
+		ShardId:           aws.String(s.ShardID),
+		ShardIteratorType: aws.String(s.IteratorType),
+	}
+	if s.SequenceNumber != "" {
+		params.StartingSequenceNumber = aws.String(s.SequenceNumber)
+	}
+	if !s.Timestamp.IsZero() {
+		params.Timestamp = aws.Time(s.Timestamp)
+	}
+	resp, err := c.svc.GetShardIterator(params)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ShardIterator, nil
+}
+
+// consumeShard reads a shard until it is closed or an unrecoverable error
+// occurs. In the latter case the next shard sync starts it again from its
+// last checkpoint.
+func (c *kinesisConsumer) consumeShard(s shardStart) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.running, s.ShardID)
+		c.mu.Unlock()
+	}()
+
+	// readFrom is when the shard was last read up to. Until a record is
+	// read, an expired iterator resumes from there rather than from the
+	// initial position, which for LATEST would skip the records that
+	// arrived in between.
+	readFrom := time.Now()
+	iterator, err := c.shardIterator(s)
+	for err == nil {
+		var resp *kinesis.GetRecordsOutput
+		readAt := time.Now()
+		resp, err = c.svc.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(config.KinesisMaxRecords),
+		})
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case kinesis.ErrCodeProvisionedThroughputExceededException:
+				log.Printf("%s %s", "kinesis read throttled for shard", s.ShardID)
+				time.Sleep(time.Duration(config.KinesisPollInterval) * time.Second)
+				err = nil
+				continue
+			case kinesis.ErrCodeExpiredIteratorException:
+				// Resume after the last record read, whether or not it
+				// was checkpointed.
+				if s.SequenceNumber != "" {
+					s.IteratorType = kinesis.ShardIteratorTypeAfterSequenceNumber
+					s.Timestamp = time.Time{}
+				} else if s.IteratorType == kinesis.ShardIteratorTypeLatest || s.IteratorType == kinesis.ShardIteratorTypeAtTimestamp {
+					s.IteratorType = kinesis.ShardIteratorTypeAtTimestamp
+					s.Timestamp = readFrom
+				}
+				iterator, err = c.shardIterator(s)
+				continue
+			}
+		}
+		if err != nil {
+			break
+		}
+		readFrom = readAt
+
+		for _, rec := range resp.Records {
+			// A record that can't be processed, eg. an S3 event whose object
+			// can't be fetched, is reported but doesn't hold back the shard.
+			seq := aws.StringValue(rec.SequenceNumber)
+			if perr := processMessage(c.d, c.s3svc, c.format, c.tags, string(rec.Data)); perr != nil {
+				log.Printf("process kinesis record error: %s %s\n%v", s.ShardID, seq, perr)
+				sendEvent(c.d, statsd.Event{
+					Title:     "process kinesis record error",
+					Text:      fmt.Sprintf("%s %s %s %v", c.stream, s.ShardID, seq, perr),
+					AlertType: statsd.Error,
+				})
+			}
+			s.SequenceNumber = seq
+		}
+		if len(resp.Records) > 0 {
+			if err = c.cp.setCheckpoint(s.ShardID, s.SequenceNumber); err != nil {
+				break
+			}
+		}
+
+		if resp.NextShardIterator == nil {
+			log.Printf("%s %s %s", "kinesis shard closed", c.stream, s.ShardID)
+			err = c.cp.setCheckpoint(s.ShardID, shardEnd)
+			break
+		}
+		iterator = resp.NextShardIterator
+		time.Sleep(time.Duration(config.KinesisPollInterval) * time.Second)
+	}
+
+	if err != nil {
+		log.Printf("kinesis read shard error: %s %s\n%v", c.stream, s.ShardID, err)
+		sendEvent(c.d, statsd.Event{
+			Title:     "kinesis read shard error",
+			Text:      fmt.Sprintf("%s %s %v", c.stream, s.ShardID, err),
+			AlertType: statsd.Error,
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+type mapCheckpointer map[string]string
+
+func (c mapCheckpointer) checkpoint(key string) (string, error) {
+	return c[key], nil
+}
+
+func (c mapCheckpointer) setCheckpoint(key, value string) error {
+	c[key] = value
+	return nil
+}
+
+func TestRealtimeRecord(t *testing.T) {
+	fields := []string{"timestamp", "c-ip", "sc-status", "cs-host", "cs-user-agent", "x-edge-location", "time-taken"}
+	line := "1519866123.456\t1.8.1.160\t200\tcdn.example.com\tcurl/7.58.0%20(x86_64)\tSYD1\t0.102\n"
+
+	actual, err := realtimeRecord(fields, line)
+	if err != nil {
+		t.Fatalf("realtimeRecord: unexpected error %v", err)
+	}
+	expected := logRecord{
+		"timestamp":       "1519866123.456",
+		"date":            "2018-03-01",
+		"time":            "01:02:03",
+		"c-ip":            "1.8.1.160",
+		"sc-status":       "200",
+		"cs(Host)":        "cdn.example.com",
+		"cs(User-Agent)":  "curl/7.58.0 (x86_64)",
+		"x-edge-location": "SYD1",
+		"time-taken":      "0.102",
+	}
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Errorf("realtimeRecord: %v", diff)
+	}
+
+	if _, err := realtimeRecord(fields, "1519866123.456\t1.8.1.160"); err == nil {
+		t.Errorf("realtimeRecord: expected error for missing fields, actual nil")
+	}
+}
+
+func shard(id string, parents ...string) *kinesis.Shard {
+	s := &kinesis.Shard{ShardId: aws.String(id)}
+	if len(parents) > 0 {
+		s.ParentShardId = aws.String(parents[0])
+	}
+	if len(parents) > 1 {
+		s.AdjacentParentShardId = aws.String(parents[1])
+	}
+	return s
+}
+
+func TestReadyShards(t *testing.T) {
+	var data = []struct {
+		name     string
+		shards   []*kinesis.Shard
+		cp       mapCheckpointer
+		running  map[string]bool
+		expected []shardStart
+	}{
+		{
+			"new stream",
+			[]*kinesis.Shard{shard("s0"), shard("s1")},
+			mapCheckpointer{},
+			nil,
+			[]shardStart{{ShardID: "s0", IteratorType: "LATEST"}, {ShardID: "s1", IteratorType: "LATEST"}},
+		},
+		{
+			"resume and skip running",
+			[]*kinesis.Shard{shard("s0"), shard("s1")},
+			mapCheckpointer{"s0": "4959"},
+			map[string]bool{"s1": true},
+			[]shardStart{{ShardID: "s0", IteratorType: "AFTER_SEQUENCE_NUMBER", SequenceNumber: "4959"}},
+		},
+		{
+			"split waits for parent",
+			[]*kinesis.Shard{shard("s0"), shard("s1", "s0"), shard("s2", "s0")},
+			mapCheckpointer{"s0": "4959"},
+			map[string]bool{"s0": true},
+			nil,
+		},
+		{
+			"split after parent closed",
+			[]*kinesis.Shard{shard("s0"), shard("s1", "s0"), shard("s2", "s0")},
+			mapCheckpointer{"s0": shardEnd},
+			nil,
+			[]shardStart{{ShardID: "s1", IteratorType: "TRIM_HORIZON"}, {ShardID: "s2", IteratorType: "TRIM_HORIZON"}},
+		},
+		{
+			"merge waits for both parents",
+			[]*kinesis.Shard{shard("s1"), shard("s2"), shard("s3", "s1", "s2")},
+			mapCheckpointer{"s1": shardEnd, "s2": "4960"},
+			map[string]bool{"s2": true},
+			nil,
+		},
+		{
+			"expired parent",
+			[]*kinesis.Shard{shard("s3", "s1", "s2")},
+			mapCheckpointer{},
+			nil,
+			[]shardStart{{ShardID: "s3", IteratorType: "LATEST"}},
+		},
+	}
+
+	for _, tt := range data {
+		actual, err := readyShards(tt.shards, tt.cp, tt.running, "LATEST")
+		if err != nil {
+			t.Errorf("readyShards(%s): unexpected error %v", tt.name, err)
+		}
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("readyShards(%s): expected %v, actual %v", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+// fakeKinesis returns the GetRecords responses and errors in order and
+// records the shard iterators requested.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+	iterators []*kinesis.GetShardIteratorInput
+	responses []*kinesis.GetRecordsOutput
+	errors    []error
+}
+
+func (f *fakeKinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	f.iterators = append(f.iterators, input)
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+}
+
+func (f *fakeKinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	resp, err := f.responses[0], f.errors[0]
+	f.responses, f.errors = f.responses[1:], f.errors[1:]
+	return resp, err
+}
+
+func TestConsumeShardExpiredIterator(t *testing.T) {
+	defer func(interval int) { config.KinesisPollInterval = interval }(config.KinesisPollInterval)
+	config.KinesisPollInterval = 0
+
+	expired := awserr.New(kinesis.ErrCodeExpiredIteratorException, "expired", nil)
+	record := func(seq string) *kinesis.Record {
+		return &kinesis.Record{SequenceNumber: aws.String(seq), Data: []byte(`{"x-edge-location":"SYD1"}`)}
+	}
+	svc := &fakeKinesis{
+		responses: []*kinesis.GetRecordsOutput{
+			{NextShardIterator: aws.String("next")},
+			nil,
+			{Records: []*kinesis.Record{record("1"), record("2")}, NextShardIterator: aws.String("next")},
+			nil,
+			{},
+		},
+		errors: []error{nil, expired, nil, expired, nil},
+	}
+	cp := mapCheckpointer{}
+	c := &kinesisConsumer{d: nopClient{}, svc: svc, cp: cp, stream: "logs", format: formatJSON, running: make(map[string]bool)}
+	c.consumeShard(shardStart{ShardID: "s0", IteratorType: "LATEST"})
+
+	// Before any record is read an expired iterator resumes from when the
+	// shard was last read, afterwards from the last record read.
+	var types []string
+	for _, it := range svc.iterators {
+		types = append(types, aws.StringValue(it.ShardIteratorType))
+	}
+	if diff := deep.Equal(types, []string{"LATEST", "AT_TIMESTAMP", "AFTER_SEQUENCE_NUMBER"}); diff != nil {
+		t.Fatalf("consumeShard: unexpected iterators %v", types)
+	}
+	if svc.iterators[1].Timestamp == nil {
+		t.Errorf("consumeShard: expected AT_TIMESTAMP iterator with a timestamp")
+	}
+	if seq := aws.StringValue(svc.iterators[2].StartingSequenceNumber); seq != "2" || svc.iterators[2].Timestamp != nil {
+		t.Errorf("consumeShard: expected AFTER_SEQUENCE_NUMBER 2, actual %s %v", seq, svc.iterators[2].Timestamp)
+	}
+	if cp["s0"] != shardEnd {
+		t.Errorf("consumeShard: expected checkpoint %s, actual %s", shardEnd, cp["s0"])
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", 1)
+	c.add("b", 2)
+	c.get("a")
+	c.add("c", 3)
+
+	var data = []struct {
+		key      string
+		expected interface{}
+		ok       bool
+	}{
+		{"a", 1, true},
+		{"b", nil, false},
+		{"c", 3, true},
+	}
+	for _, tt := range data {
+		actual, ok := c.get(tt.key)
+		if actual != tt.expected || ok != tt.ok {
+			t.Errorf("get(%s): expected %v %v, actual %v %v", tt.key, tt.expected, tt.ok, actual, ok)
+		}
+	}
+
+	c.add("a", 4)
+	if actual, _ := c.get("a"); actual != 4 || c.len() != 2 {
+		t.Errorf("add(a): expected 4 in 2 entries, actual %v in %d", actual, c.len())
+	}
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
-	"strconv"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,7 +14,11 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 // Version in reality, I would like this to match Git tag but I am not sure
@@ -26,11 +31,127 @@ var config struct {
 	ChannelBufferSize        int64  `env:"CHANNEL_BUFFER_SIZE,default=10"`
 	Club                     string `env:"CLUB_NAME,required"`
 	SqsRegion                string `env:"SQS_REGION,default=us-west-2"`
-	SqsQueueURL              string `env:"SQS_QUEUE_URL,required"`
+	SqsQueueURL              string `env:"SQS_QUEUE_URL"`
 	SqsWaitTimeSeconds       int64  `env:"SQS_WAIT_TIME_SECONDS,default=10"`
 	SqsMaxNumberOfMessages   int64  `env:"SQS_MAX_NUMBER_OF_MESSAGES,default=10"`
 	SqsVisibilityTimeout     int64  `env:"SQS_VISIBILITY_TIMEOUT,default=300"`
 	SqsMessageAttributeNames string `env:"SQS_MESSAGE_ATTRIBUTE_NAME,default=cloudfront"`
+	// SqsMessageFormat is one of "json", a pre-parsed JSON log line per
+	// message, "w3c", raw CloudFront log lines per message, "realtime",
+	// CloudFront real-time log lines per message, or "s3", an S3
+	// ObjectCreated notification per message.
+	SqsMessageFormat string `env:"SQS_MESSAGE_FORMAT,default=json"`
+	// SqsQueuesConfig is the path of a JSON file listing several queues with
+	// their own settings, see queue. It replaces SqsQueueURL.
+	SqsQueuesConfig string `env:"SQS_QUEUES_CONFIG"`
+	// SqsMessageEncoding is "auto", which detects base64, gzip and zstd
+	// encoded bodies, "none", or the encodings applied to bodies in order,
+	// eg. "gzip,base64". A message's SqsEncodingAttributeName attribute
+	// overrides it.
+	SqsMessageEncoding       string `env:"SQS_MESSAGE_ENCODING,default=auto"`
+	SqsEncodingAttributeName string `env:"SQS_ENCODING_ATTRIBUTE_NAME,default=content-encoding"`
+	// SqsAttributeRules is the semicolon separated list of attribute rules
+	// applied to messages, see attributeRule.
+	SqsAttributeRules []string `env:"SQS_ATTRIBUTE_RULES"`
+	// SqsMinGoRoutine and SqsMaxGoRoutine enable scaling each queue's
+	// workers with its backlog, see desiredWorkers. They default to
+	// GoRoutine, ie. a fixed number of workers.
+	SqsMinGoRoutine            int   `env:"SQS_MIN_GOROUTINE"`
+	SqsMaxGoRoutine            int   `env:"SQS_MAX_GOROUTINE"`
+	SqsAutoscaleInterval       int   `env:"SQS_AUTOSCALE_INTERVAL,default=30"`
+	SqsAutoscaleTargetMessages int64 `env:"SQS_AUTOSCALE_TARGET_MESSAGES,default=100"`
+	SqsAutoscaleMaxAge         int   `env:"SQS_AUTOSCALE_MAX_AGE,default=300"`
+	// SnsSigningCert is the path of a PEM certificate used to verify the
+	// signature of SNS envelopes. Unsigned or invalid envelopes are rejected.
+	SnsSigningCert string `env:"SNS_SIGNING_CERT"`
+	// KinesisStreamName enables reading CloudFront real-time logs from a
+	// Kinesis data stream. KinesisRegion defaults to SqsRegion.
+	KinesisStreamName        string `env:"KINESIS_STREAM_NAME"`
+	KinesisRegion            string `env:"KINESIS_REGION"`
+	KinesisInitialPosition   string `env:"KINESIS_INITIAL_POSITION,default=LATEST"`
+	KinesisRecordFormat      string `env:"KINESIS_RECORD_FORMAT,default=realtime"`
+	KinesisMaxRecords        int64  `env:"KINESIS_MAX_RECORDS,default=1000"`
+	KinesisPollInterval      int    `env:"KINESIS_POLL_INTERVAL,default=1"`
+	KinesisShardSyncInterval int    `env:"KINESIS_SHARD_SYNC_INTERVAL,default=60"`
+	// Shard checkpoints are kept in either a local file or a DynamoDB table.
+	KinesisCheckpointFile  string `env:"KINESIS_CHECKPOINT_FILE"`
+	KinesisCheckpointTable string `env:"KINESIS_CHECKPOINT_TABLE"`
+	// RealtimeLogFields is the semicolon separated field list of the
+	// real-time log configuration.
+	RealtimeLogFields []string `env:"REALTIME_LOG_FIELDS"`
+	// FirehoseListenAddr enables the Kinesis Data Firehose HTTP endpoint,
+	// eg. ":8443". Firehose requires HTTPS, so it is expected to sit behind
+	// a TLS terminating load balancer. Deliveries must carry
+	// FirehoseAccessKey unless FirehoseAllowUnauthenticated is set.
+	FirehoseListenAddr           string `env:"FIREHOSE_LISTEN_ADDR"`
+	FirehoseAccessKey            string `env:"FIREHOSE_ACCESS_KEY"`
+	FirehoseAllowUnauthenticated bool   `env:"FIREHOSE_ALLOW_UNAUTHENTICATED,default=false"`
+	FirehoseRecordFormat         string `env:"FIREHOSE_RECORD_FORMAT,default=json"`
+	FirehoseMaxBodySize          int64  `env:"FIREHOSE_MAX_BODY_SIZE,default=67108864"`
+	// HTTPInputListenAddr enables the HTTP endpoint log shippers POST JSON
+	// or NDJSON batches of records to, eg. ":8080". Requests must carry
+	// HTTPInputToken as a bearer token unless HTTPInputAllowUnauthenticated
+	// is set.
+	HTTPInputListenAddr           string `env:"HTTP_INPUT_LISTEN_ADDR"`
+	HTTPInputToken                string `env:"HTTP_INPUT_TOKEN"`
+	HTTPInputAllowUnauthenticated bool   `env:"HTTP_INPUT_ALLOW_UNAUTHENTICATED,default=false"`
+	HTTPInputMaxBodySize          int64  `env:"HTTP_INPUT_MAX_BODY_SIZE,default=10485760"`
+	// ForwardListenAddr enables the Fluentd Forward protocol listener, eg.
+	// ":24224". JSON records are processed whole, records of any other
+	// format are read from the ForwardMessageKey field.
+	ForwardListenAddr   string `env:"FORWARD_LISTEN_ADDR"`
+	ForwardRecordFormat string `env:"FORWARD_RECORD_FORMAT,default=json"`
+	ForwardMessageKey   string `env:"FORWARD_MESSAGE_KEY,default=message"`
+	ForwardMaxChunkSize int    `env:"FORWARD_MAX_CHUNK_SIZE,default=67108864"`
+	// SchemaDriftInterval is how often changes to the fields of incoming
+	// records are reported. A field vanishes once it hasn't been seen for
+	// SchemaDriftWindow while records kept arriving.
+	SchemaDriftInterval int `env:"SCHEMA_DRIFT_INTERVAL,default=300"`
+	SchemaDriftWindow   int `env:"SCHEMA_DRIFT_WINDOW,default=3600"`
+	// GeoIPCityDB and GeoIPASNDB are GeoIP2 or GeoLite2 City (or Country)
+	// and ASN databases to look up the location and network of clients in.
+	// They are read again when they change, checked every
+	// GeoIPReloadInterval seconds.
+	GeoIPCityDB         string `env:"GEOIP_CITY_DB"`
+	GeoIPASNDB          string `env:"GEOIP_ASN_DB"`
+	GeoIPReloadInterval int    `env:"GEOIP_RELOAD_INTERVAL,default=60"`
+	// TrustedProxies are the semicolon separated CIDRs or addresses of the
+	// proxies whose X-Forwarded-For is followed to the client's address,
+	// see resolveClientIP.
+	TrustedProxies []string `env:"TRUSTED_PROXIES,default=private"`
+	// EdgeLocationsFile adds or replaces the POPs of the built in edge
+	// location table, see edgeLocationsCSV.
+	EdgeLocationsFile string `env:"EDGE_LOCATIONS_FILE"`
+	// URIRules is the semicolon separated list of rules the cs_uri_stem tag
+	// is normalised with, see parseURIRules.
+	URIRules []string `env:"URI_RULES,default=uuid;date;hex;number;ext;depth:8"`
+	// QueryTagParams are the semicolon separated query string parameters
+	// promoted to tags of their own. QueryOtherParams is "drop", which
+	// leaves the other parameters out of the cs_uri_query tag, or "hash",
+	// which tags them with a hash. Records with any of the
+	// QueryCacheBusterParams are tagged query_cache_buster:true.
+	QueryTagParams         []string `env:"QUERY_TAG_PARAMS"`
+	QueryOtherParams       string   `env:"QUERY_OTHER_PARAMS,default=drop"`
+	QueryCacheBusterParams []string `env:"QUERY_CACHE_BUSTER_PARAMS,default=_;cb;cachebust;cachebuster;nocache;nc;rand;random;rnd;ts;timestamp"`
+	// MetricTagsRequest, MetricTagsResultType and MetricTagsRequestTime are
+	// the semicolon separated names of the record tags the request,
+	// result_type and request_time metrics are sent with, see tagAllowlist.
+	// "*" allows every tag.
+	MetricTagsRequest     []string `env:"METRIC_TAGS_REQUEST,default=x_edge_location;edge_*;x_edge_result_type;cs_method;sc_status;cs_uri_stem;query_*;x_host_header;cs_protocol;cs_protocol_version;ssl_protocol;cs_host;client_*;browser;os;device;bot"`
+	MetricTagsResultType  []string `env:"METRIC_TAGS_RESULT_TYPE,default=x_edge_location;edge_*;x_edge_result_type;x_edge_response_result_type;sc_status;cs_uri_stem;cs_host"`
+	MetricTagsRequestTime []string `env:"METRIC_TAGS_REQUEST_TIME,default=x_edge_location;edge_*;x_edge_result_type;cs_method;sc_status;cs_uri_stem;cs_protocol_version;cs_host"`
+	// TagCardinalityLimit caps the distinct values of every record tag in
+	// TagCardinalityWindow seconds, and TagCardinalityLimits overrides it
+	// per tag with semicolon separated TAG=LIMIT rules. Values past the cap
+	// are sent as "other". The cardinality of every tag is reported every
+	// TagCardinalityInterval seconds.
+	TagCardinalityLimit    int      `env:"TAG_CARDINALITY_LIMIT,default=1000"`
+	TagCardinalityLimits   []string `env:"TAG_CARDINALITY_LIMITS"`
+	TagCardinalityWindow   int      `env:"TAG_CARDINALITY_WINDOW,default=3600"`
+	TagCardinalityInterval int      `env:"TAG_CARDINALITY_INTERVAL,default=60"`
+	// UserAgentCacheSize is how many User-Agents keep their classification
+	// cached.
+	UserAgentCacheSize int `env:"USER_AGENT_CACHE_SIZE,default=10000"`
 	// StatsdHost format host:port. Eg. 127.0.0.1:8125
 	// Only supports UDP since we rely on dogstatsd/datadog agent config.
 	StatsdHost        string `env:"STATSD_HOST,required"`
@@ -39,9 +160,17 @@ var config struct {
 	HeartbeatTimeout  int    `env:"HEARTBEAT_INTERVAL,default=10"`
 }
 
-type queue struct {
-	URL     string
-	Message *sqs.Message
+// logRecord holds a single CloudFront access log entry keyed by its
+// CloudFront field name, eg. "c-ip" or "x-edge-location".
+type logRecord map[string]string
+
+// metricClient is the subset of the dogstatsd client we use, so metrics can
+// be printed instead of sent, eg. by a replay dry run.
+type metricClient interface {
+	Incr(name string, tags []string, rate float64) error
+	Gauge(name string, value float64, tags []string, rate float64) error
+	Count(name string, value int64, tags []string, rate float64) error
+	Event(e *statsd.Event) error
 }
 
 const (
@@ -49,10 +178,38 @@ const (
 	sourceApp         = "cloudfront_log_metric_parser"
 )
 
+const (
+	formatJSON     = "json"
+	formatW3C      = "w3c"
+	formatRealtime = "realtime"
+	formatS3       = "s3"
+)
+
 func init() {
 	if err := envdecode.Decode(&config); err != nil {
 		log.Fatalf("%s\n", err.Error())
 	}
+	userAgentCache = newLRUCache(config.UserAgentCacheSize)
+	var err error
+	if uriRules, err = parseURIRules(config.URIRules); err != nil {
+		log.Fatalf("%s\n", err.Error())
+	}
+	if trustedProxies, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalf("%s\n", err.Error())
+	}
+	if queryParams, err = newQueryRules(config.QueryTagParams, config.QueryOtherParams, config.QueryCacheBusterParams); err != nil {
+		log.Fatalf("%s\n", err.Error())
+	}
+	metricAllowlists = map[string]*tagAllowlist{
+		"request":      newTagAllowlist(config.MetricTagsRequest),
+		"result_type":  newTagAllowlist(config.MetricTagsResultType),
+		"request_time": newTagAllowlist(config.MetricTagsRequestTime),
+	}
+	limits, err := parseCardinalityLimits(config.TagCardinalityLimits)
+	if err != nil {
+		log.Fatalf("%s\n", err.Error())
+	}
+	tagLimiter = newCardinalityLimiter(config.TagCardinalityLimit, limits)
 }
 
 func main() {
@@ -63,8 +220,57 @@ func main() {
 	// below in .env work well maybe?
 	log.Printf("version %s\n", Version)
 
+	// GeoIP databases and edge locations enrich replayed and backfilled
+	// metrics too.
+	if err := openGeoIP(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadEdgeLocations(config.EdgeLocationsFile); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replay(os.Args[2:]))
+		case "backfill":
+			os.Exit(backfill(os.Args[2:]))
+		}
+	}
+
 	log.Printf("%s %d\n", "Goroutine set to", config.GoRoutine)
 
+	if config.SqsQueueURL == "" && config.SqsQueuesConfig == "" && config.KinesisStreamName == "" && config.FirehoseListenAddr == "" && config.HTTPInputListenAddr == "" && config.ForwardListenAddr == "" {
+		log.Fatalf("%s\n", "one of SQS_QUEUE_URL, SQS_QUEUES_CONFIG, KINESIS_STREAM_NAME, FIREHOSE_LISTEN_ADDR, HTTP_INPUT_LISTEN_ADDR or FORWARD_LISTEN_ADDR must be set")
+	}
+
+	if !validFormat(config.SqsMessageFormat) {
+		log.Fatalf("unknown SQS_MESSAGE_FORMAT %q\n", config.SqsMessageFormat)
+	}
+	if !validFormat(config.KinesisRecordFormat) {
+		log.Fatalf("unknown KINESIS_RECORD_FORMAT %q\n", config.KinesisRecordFormat)
+	}
+	if !validFormat(config.FirehoseRecordFormat) {
+		log.Fatalf("unknown FIREHOSE_RECORD_FORMAT %q\n", config.FirehoseRecordFormat)
+	}
+	if config.FirehoseListenAddr != "" && config.FirehoseAccessKey == "" && !config.FirehoseAllowUnauthenticated {
+		log.Fatalf("%s\n", "FIREHOSE_ACCESS_KEY must be set, or FIREHOSE_ALLOW_UNAUTHENTICATED=true to accept unauthenticated deliveries")
+	}
+	if config.HTTPInputListenAddr != "" && config.HTTPInputToken == "" && !config.HTTPInputAllowUnauthenticated {
+		log.Fatalf("%s\n", "HTTP_INPUT_TOKEN must be set, or HTTP_INPUT_ALLOW_UNAUTHENTICATED=true to accept unauthenticated requests")
+	}
+	if !validFormat(config.ForwardRecordFormat) {
+		log.Fatalf("unknown FORWARD_RECORD_FORMAT %q\n", config.ForwardRecordFormat)
+	}
+
+	if config.SnsSigningCert != "" {
+		var err error
+		if snsCert, err = loadSNSCertificate(config.SnsSigningCert); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s %s\n", "verify SNS signatures with", config.SnsSigningCert)
+	}
+
 	var wg sync.WaitGroup
 	region := config.SqsRegion
 	conf := &aws.Config{
@@ -75,7 +281,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	svc := sqs.New(sess)
+	s3svc := s3.New(sess)
 
 	m, err := statsd.New(config.StatsdHost)
 	if err != nil {
@@ -84,41 +290,90 @@ func main() {
 	// prefix every metric with the app name
 	m.Namespace = config.StatsdPrefix
 
-	messageStreamInput := make(chan *sqs.Message, config.ChannelBufferSize)
-	deleteMessageStream := make(chan *string, config.ChannelBufferSize)
-	aliveParser := make(chan string)
-	aliveDelete := make(chan string)
-	// We do +1 below because i starts from non zero.
-	for i := minGoroutineCount; i <= numLoop(config.GoRoutine); i += minGoroutineCount {
-		wg.Add(i)
-		go receiveMessage(m, svc, messageStreamInput, &wg)
-		go parseMessage(m, messageStreamInput, deleteMessageStream, &wg, aliveParser)
-		go deleteMessage(m, svc, deleteMessageStream, &wg, aliveDelete)
-		go heartbeatParse(m, aliveParser, &wg)
-		go heartbeatDelete(m, aliveDelete, &wg)
+	queues, err := loadQueues()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, q := range queues {
+		qsess := sess
+		if q.Region != region {
+			qsess = sess.Copy(&aws.Config{Region: aws.String(q.Region)})
+		}
+		log.Printf("%s %s %s %s\n", "receive messages from queue", q.Name, q.URL, q.Format)
+		startQueue(m, q, sqs.New(qsess), s3.New(qsess), &wg)
+	}
+
+	if config.KinesisStreamName != "" {
+		ksess := sess
+		if config.KinesisRegion != "" {
+			ksess = sess.Copy(&aws.Config{Region: aws.String(config.KinesisRegion)})
+		}
+		cp, err := newCheckpointer(ksess, config.KinesisCheckpointFile, config.KinesisCheckpointTable, config.KinesisStreamName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s %s\n", "read real-time logs from kinesis stream", config.KinesisStreamName)
+		wg.Add(1)
+		go newKinesisConsumer(m, kinesis.New(ksess), s3.New(ksess), cp).run(&wg)
+	}
+	if config.FirehoseListenAddr != "" {
+		log.Printf("%s %s\n", "listen for firehose deliveries on", config.FirehoseListenAddr)
+		wg.Add(1)
+		go serveFirehose(m, s3svc, &wg)
+	}
+	if config.HTTPInputListenAddr != "" {
+		log.Printf("%s %s\n", "listen for http input on", config.HTTPInputListenAddr)
+		startHTTPInput(m, s3svc, &wg)
+	}
+	if config.ForwardListenAddr != "" {
+		log.Printf("%s %s\n", "listen for fluentd forward connections on", config.ForwardListenAddr)
+		wg.Add(1)
+		go serveForward(m, s3svc, &wg)
+	}
+	wg.Add(1)
+	go reportDrift(m, &wg)
+	wg.Add(1)
+	go reportCardinality(m, &wg)
+	if geoCity != nil || geoASN != nil {
+		wg.Add(1)
+		go reloadGeoIP(m, &wg)
 	}
 	wg.Wait()
 	log.Printf("%s\n", "cloudfront metric generator stopped")
 }
 
+func validFormat(format string) bool {
+	switch format {
+	case formatJSON, formatW3C, formatRealtime, formatS3:
+		return true
+	}
+	return false
+}
+
 func numLoop(v int) int {
 	return (minGoroutineCount * v)
 }
 
-func receiveMessage(d *statsd.Client, svc *sqs.SQS, messageStreamInput chan *sqs.Message, wg *sync.WaitGroup) {
+// receiveMessage receives messages until stop is closed, passing each to
+// observe before queueing it for parsing.
+func receiveMessage(d metricClient, q *queue, svc sqsiface.SQSAPI, messageStreamInput chan *sqs.Message, wg *sync.WaitGroup, stop <-chan struct{}, observe func(*sqs.Message)) {
 	defer wg.Done()
 
 	params := &sqs.ReceiveMessageInput{
-		QueueUrl:            &config.SqsQueueURL,
-		WaitTimeSeconds:     &config.SqsWaitTimeSeconds,
-		MaxNumberOfMessages: &config.SqsMaxNumberOfMessages,
-		VisibilityTimeout:   &config.SqsVisibilityTimeout,
-		MessageAttributeNames: []*string{
-			aws.String(config.SqsMessageAttributeNames),
-		},
+		QueueUrl:              &q.URL,
+		WaitTimeSeconds:       &q.WaitTimeSeconds,
+		MaxNumberOfMessages:   &q.MaxNumberOfMessages,
+		VisibilityTimeout:     &q.VisibilityTimeout,
+		AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameSentTimestamp)},
+		MessageAttributeNames: aws.StringSlice(q.attributeNames()),
 	}
 
 	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
 		resp, err := svc.ReceiveMessage(params)
 		if err != nil {
 			log.Fatalf("%v\n%v", params, err)
@@ -128,8 +383,11 @@ func receiveMessage(d *statsd.Client, svc *sqs.SQS, messageStreamInput chan *sqs
 			log.Printf("%s", "receive message from SQS")
 			sendEvent(d, statsd.Event{
 				Title: "recieve SQS message",
-				Text:  fmt.Sprintf("%s %s", "received message from queue", config.SqsQueueURL),
+				Text:  fmt.Sprintf("%s %s", "received message from queue", q.URL),
 			})
+			if observe != nil {
+				observe(i)
+			}
 			messageStreamInput <- i
 		}
 	}
@@ -143,6 +401,20 @@ func appendTags(values ...string) []string {
 	return tags
 }
 
+// withTags returns a copy of base with values appended, so base can be
+// shared between metrics.
+func withTags(base []string, values ...string) []string {
+	tags := make([]string, 0, len(base)+len(values))
+	tags = append(tags, base...)
+	return append(tags, values...)
+}
+
+// defaultTags are the tags of records that don't come from a configured
+// SQS queue.
+func defaultTags() []string {
+	return appendTags(createTag("club_name", config.Club))
+}
+
 func createTag(k, v string) string {
 	return k + ":" + v
 }
@@ -155,169 +427,293 @@ func getFloat(msg, v string) float64 {
 	return gjson.GetBytes([]byte(msg), v).Float()
 }
 
-func parseMessage(d *statsd.Client,
+func parseMessage(d metricClient,
+	q *queue,
+	s3svc s3iface.S3API,
 	messageStreamInput <-chan *sqs.Message,
 	deleteMessageStream chan<- *string,
 	wg *sync.WaitGroup,
-	aliveParser chan<- string) {
+	aliveParser chan<- string,
+	stop <-chan struct{}) {
 	wg.Done()
 	for {
 		select {
+		case <-stop:
+			return
 		case msg := <-messageStreamInput:
-
-			var err error
-			cIP := getString(string(*msg.Body), "c-ip")
-			timeTaken := getFloat(string(*msg.Body), "time-taken")
-			csURIStem := getString(string(*msg.Body), "cs-uri-stem")
-			xEdgeLocation := getString(string(*msg.Body), "x-edge-location")
-			xEdgeResultType := getString(string(*msg.Body), "x-edge-result-type")
-			date := getString(string(*msg.Body), "date")
-			time := getString(string(*msg.Body), "time")
-			csMethod := getString(string(*msg.Body), "cs-method")
-			scStatus := getString(string(*msg.Body), "sc-status")
-			csURIQuery := getString(string(*msg.Body), "cs-uri-query")
-			xEdgeRequestID := getString(string(*msg.Body), "x-edge-request-id")
-			xHostHeader := getString(string(*msg.Body), "x-host-header")
-			csProtocol := getString(string(*msg.Body), "cs-protocol")
-			xff := getString(string(*msg.Body), "x-forwarded-for")
-			sslProto := getString(string(*msg.Body), "ssl-protocol")
-			sslCipher := getString(string(*msg.Body), "ssl_cipher")
-			xEdgeResponseResultType := getString(string(*msg.Body), "x-edge-response-result-type")
-			csProtocolVersion := getString(string(*msg.Body), "cs-protocol-version")
-			fleStatus := getString(string(*msg.Body), "fle-status")
-			fleEncryptedFields := getString(string(*msg.Body), "fle-encrypted-fields")
-			csHost := getString(string(*msg.Body), "cs(Host)")
-			csUserAgent := getString(string(*msg.Body), "cs(User-Agent)")
-
-			err = d.Incr("request",
-				appendTags(
-					createTag("club_name", config.Club),
-					createTag("c_ip", cIP),
-					createTag("time_taken", strconv.FormatFloat(timeTaken, 'G', -1, 32)),
-					createTag("cs_uri_stem", csURIStem),
-					createTag("x_edge_location", xEdgeLocation),
-					createTag("x_edge_result_type", xEdgeResultType),
-					createTag("date", date),
-					createTag("time", time),
-					createTag("cs_method", csMethod),
-					createTag("sc_status", scStatus),
-					createTag("cs_uri_query", csURIQuery),
-					createTag("x_edge_request_id", xEdgeRequestID),
-					createTag("x_host_header", xHostHeader),
-					createTag("cs_protocol", csProtocol),
-					createTag("x_forwarded_for", xff),
-					createTag("ssl_protocol", sslProto),
-					createTag("ssl_cipher", sslCipher),
-					createTag("x_edge_response_result_type", xEdgeResponseResultType),
-					createTag("cs_protocol_version", csProtocolVersion),
-					createTag("fle_status", fleStatus),
-					createTag("fle_encrypted_fields", fleEncryptedFields),
-					createTag("cs_host", csHost),
-					createTag("cs_user_agent", csUserAgent)),
-				1)
+			// On failure the message becomes visible again after the
+			// visibility timeout and is retried.
+			body, err := decodeMessage(d, q, msg)
 			if err != nil {
-				log.Printf("datadog request count metric error: %v\n%v", msg, err)
+				log.Printf("decode SQS message error: %v\n%v", *msg.Body, err)
 				sendEvent(d, statsd.Event{
-					Title:     "datadog metric error",
-					Text:      fmt.Sprintf("%s: %v. %v", "datadog request count metric error", msg, err),
+					Title:     "decode SQS message error",
+					Text:      fmt.Sprintf("%v %v", *msg.Body, err),
 					AlertType: statsd.Error,
 				})
+				continue
 			}
-
-			// request result type: Miss, Hit and etc per object in cache/file per edge location
-			// files that don't exist
-			err = d.Incr("result_type",
-				appendTags(
-					createTag("club_name", config.Club),
-					createTag("c_ip", cIP),
-					createTag("time_taken", strconv.FormatFloat(timeTaken, 'G', -1, 32)),
-					createTag("cs_uri_stem", csURIStem),
-					createTag("x_edge_location", xEdgeLocation),
-					createTag("x_edge_result_type", xEdgeResultType),
-					createTag("date", date),
-					createTag("time", time),
-					createTag("cs_method", csMethod),
-					createTag("sc_status", scStatus),
-					createTag("cs_uri_query", csURIQuery),
-					createTag("x_edge_request_id", xEdgeRequestID),
-					createTag("x_host_header", xHostHeader),
-					createTag("cs_protocol", csProtocol),
-					createTag("x_forwarded_for", xff),
-					createTag("ssl_protocol", sslProto),
-					createTag("ssl_cipher", sslCipher),
-					createTag("x_edge_response_result_type", xEdgeResponseResultType),
-					createTag("cs_protocol_version", csProtocolVersion),
-					createTag("fle_status", fleStatus),
-					createTag("fle_encrypted_fields", fleEncryptedFields),
-					createTag("cs_host", csHost),
-					createTag("cs_user_agent", csUserAgent)),
-				1)
+			// Messages pushed to the HTTP input don't come from SNS.
+			if q.URL != "" {
+				if err := checkSNSEnvelope(body, snsCert); err != nil {
+					log.Printf("verify SQS message error: %v\n%v", *msg.Body, err)
+					sendEvent(d, statsd.Event{
+						Title:     "verify SQS message error",
+						Text:      fmt.Sprintf("%v %v", *msg.Body, err),
+						AlertType: statsd.Error,
+					})
+					continue
+				}
+			}
+			format, tags, attributeTags, err := q.messageSettings(msg)
 			if err != nil {
-				log.Printf("datadog result_type count metric error: %v\n%v", msg, err)
+				log.Printf("route SQS message error: %v\n%v", *msg.Body, err)
 				sendEvent(d, statsd.Event{
-					Title:     "datadog metric error",
-					Text:      fmt.Sprintf("%s: %v. %v", "datadog result_type metric error", msg, err),
+					Title:     "route SQS message error",
+					Text:      fmt.Sprintf("%v %v", *msg.Body, err),
 					AlertType: statsd.Error,
 				})
+				continue
 			}
-
-			err = d.Gauge("request_time",
-				timeTaken,
-				appendTags(
-					createTag("club_name", config.Club),
-					createTag("c_ip", cIP),
-					createTag("cs_uri_stem", csURIStem),
-					createTag("x_edge_location", xEdgeLocation),
-					createTag("x_edge_result_type", xEdgeResultType),
-					createTag("date", date),
-					createTag("time", time),
-					createTag("cs_method", csMethod),
-					createTag("sc_status", scStatus),
-					createTag("cs_uri_query", csURIQuery),
-					createTag("x_edge_request_id", xEdgeRequestID),
-					createTag("x_host_header", xHostHeader),
-					createTag("cs_protocol", csProtocol),
-					createTag("x_forwarded_for", xff),
-					createTag("ssl_protocol", sslProto),
-					createTag("ssl_cipher", sslCipher),
-					createTag("x_edge_response_result_type", xEdgeResponseResultType),
-					createTag("cs_protocol_version", csProtocolVersion),
-					createTag("fle_status", fleStatus),
-					createTag("fle_encrypted_fields", fleEncryptedFields),
-					createTag("cs_host", csHost),
-					createTag("cs_user_agent", csUserAgent)),
-				1)
+			err = parseRecords(d, s3svc, format, tags, body, func(r *Record, src interface{}) {
+				emitMetrics(d, r, tags, attributeTags, src)
+			})
 			if err != nil {
-				log.Printf("datadog request_time gauge metric error: %v\n%v", msg, err)
+				log.Printf("process SQS message error: %v\n%v", *msg.Body, err)
 				sendEvent(d, statsd.Event{
-					Title:     "datadog metric error",
-					Text:      fmt.Sprintf("%s: %v. %v", "datadog request_time metric error", msg, err),
+					Title:     "process SQS message error",
+					Text:      fmt.Sprintf("%v %v", *msg.Body, err),
 					AlertType: statsd.Error,
 				})
+				continue
 			}
 			log.Printf("%s", "process SQS message")
 			sendEvent(d, statsd.Event{
 				Title: "process SQS message",
 				Text:  fmt.Sprintf("%s", "process sqs message successful"),
 			})
-			deleteMessageStream <- msg.ReceiptHandle
+			// Messages pushed to the HTTP input have no receipt handle.
+			if msg.ReceiptHandle != nil {
+				deleteMessageStream <- msg.ReceiptHandle
+			}
 		case <-time.After(time.Duration(config.HeartbeatInterval) * time.Second):
 			aliveParser <- "i am alive"
 		}
 	}
 }
 
-func deleteMessage(d *statsd.Client,
-	svc *sqs.SQS,
+// decodeMessage returns the decoded body of a message and counts its bytes
+// before and after decoding.
+func decodeMessage(d metricClient, q *queue, msg *sqs.Message) (string, error) {
+	body, encodings, err := decodeBody(*msg.Body, messageEncoding(q, msg))
+	if err != nil {
+		return "", err
+	}
+	encoding := encodingNone
+	if len(encodings) > 0 {
+		encoding = strings.Join(encodings, "+")
+	}
+	tags := withTags(q.tags(), createTag("encoding", encoding))
+	if err := d.Count("message_encoded_bytes", int64(len(*msg.Body)), tags, 1); err != nil {
+		log.Printf("%v", err)
+	}
+	if err := d.Count("message_decoded_bytes", int64(len(body)), tags, 1); err != nil {
+		log.Printf("%v", err)
+	}
+	return body, nil
+}
+
+// processMessage emits metrics tagged with tags for every log record in a
+// message body of the given format. An error means the message could not be
+// fully processed and should be retried.
+func processMessage(d metricClient, s3svc s3iface.S3API, format string, tags []string, body string) error {
+	return parseRecords(d, s3svc, format, tags, body, func(r *Record, src interface{}) {
+		emitMetrics(d, r, tags, nil, src)
+	})
+}
+
+// recordFunc receives every record parsed from a message. src gives context
+// to error reporting. Records are pooled, so r must not be kept after fn
+// returns.
+type recordFunc func(r *Record, src interface{})
+
+// parseRecords calls fn for every log record in a message body of the given
+// format. Records that can't be parsed are reported with tags and skipped.
+func parseRecords(d metricClient, s3svc s3iface.S3API, format string, tags []string, body string, fn recordFunc) error {
+	// CloudWatch Logs subscriptions deliver a batch of log events, each of
+	// which is a record in its own right.
+	if messages, ok := cloudWatchLogEvents(body); ok {
+		for _, msg := range messages {
+			if err := parseRecords(d, s3svc, format, tags, msg, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Queues subscribed to an SNS topic without raw message delivery receive
+	// the message wrapped in an SNS envelope. S3 event notifications are
+	// often fanned out this way, so they are detected whatever the format.
+	if isSNSEnvelope(body) {
+		msg, err := unwrapSNS(body, snsCert)
+		if err != nil {
+			return err
+		}
+		body = msg
+		if isS3Event(body) {
+			format = formatS3
+		}
+	}
+
+	// Log lines read from S3 objects and W3C messages that can't be parsed
+	// are counted as W3C parse errors.
+	lineErr := func(line string, err error) {
+		reportParseError(d, formatW3C, tags, line, err)
+	}
+
+	switch format {
+	case formatS3:
+		// The whole object referenced by the notification must be
+		// processed before the message is acknowledged.
+		return processS3Event(s3svc, body, fn, lineErr)
+	case formatW3C:
+		// A message may hold a single line or a whole log file
+		// including its #Version and #Fields directives.
+		// A line too long to be read fails the message, which is retried
+		// as an S3 object failing to be read would be.
+		if _, err := readLogLines(strings.NewReader(body), func(raw logRecord) {
+			r := newRecord(raw)
+			fn(r, body)
+			r.release()
+		}, lineErr); err != nil {
+			return err
+		}
+	case formatRealtime:
+		for _, line := range strings.Split(body, "\n") {
+			if line == "" {
+				continue
+			}
+			raw, err := realtimeRecord(realtimeLogFields(), line)
+			if err != nil {
+				reportParseError(d, format, tags, line, err)
+				continue
+			}
+			r := newRecord(raw)
+			fn(r, line)
+			r.release()
+		}
+	default:
+		// Shippers may pack several records into one message, either as a
+		// JSON array or as newline delimited JSON. A bad record is reported
+		// and skipped without holding back the rest of the message.
+		records := splitJSONRecords(body)
+		for i, rec := range records {
+			if !gjson.Valid(rec) || !gjson.Parse(rec).IsObject() {
+				reportParseError(d, format, tags, rec, fmt.Errorf("record %d of %d is not a JSON object", i+1, len(records)))
+				continue
+			}
+			r := newJSONRecord(rec)
+			fn(r, rec)
+			r.release()
+		}
+	}
+	return nil
+}
+
+// splitJSONRecords splits a message body holding a single JSON record, a
+// JSON array of records or newline delimited JSON records. A body that is
+// valid JSON as a whole, eg. a pretty printed record spanning several lines,
+// is not split into lines.
+func splitJSONRecords(body string) []string {
+	trimmed := strings.TrimSpace(body)
+	if gjson.Valid(trimmed) {
+		if !strings.HasPrefix(trimmed, "[") {
+			return []string{trimmed}
+		}
+		var records []string
+		for _, r := range gjson.Parse(trimmed).Array() {
+			records = append(records, r.Raw)
+		}
+		return records
+	}
+	if strings.HasPrefix(trimmed, "[") {
+		return []string{body}
+	}
+
+	var records []string
+	for _, line := range strings.Split(trimmed, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			records = append(records, line)
+		}
+	}
+	return records
+}
+
+// emitMetrics sends the request, result_type and request_time metrics for a
+// single log record, and counts its missing and invalid fields and unknown
+// POPs. Every metric carries tags, which identify where the record came from.
+// extra are tags added to the record's own, eg. by attribute rules, which like
+// them are only sent with the metrics that allow them. src is only used to
+// give context to error reporting.
+func emitMetrics(d metricClient, r *Record, tags, extra []string, src interface{}) {
+	reportFieldErrors(d, r, tags)
+	reportUnknownEdgeLocation(d, r, tags)
+
+	// Only the tags of a metric's allowlist are sent with it, and only
+	// those count towards the cardinality limits. The metric buffer is
+	// reused for every metric, as the client formats tags when called.
+	recordTags := append(r.metricTags(), extra...)
+	r.tagBuf = recordTags
+	limitTags(recordTags)
+	var err error
+	err = d.Incr("request", r.filterTags("request", tags, recordTags), 1)
+	if err != nil {
+		log.Printf("datadog request count metric error: %v\n%v", src, err)
+		sendEvent(d, statsd.Event{
+			Title:     "datadog metric error",
+			Text:      fmt.Sprintf("%s: %v. %v", "datadog request count metric error", src, err),
+			AlertType: statsd.Error,
+		})
+	}
+
+	// request result type: Miss, Hit and etc per object in cache/file per edge location
+	// files that don't exist
+	err = d.Incr("result_type", r.filterTags("result_type", tags, recordTags), 1)
+	if err != nil {
+		log.Printf("datadog result_type count metric error: %v\n%v", src, err)
+		sendEvent(d, statsd.Event{
+			Title:     "datadog metric error",
+			Text:      fmt.Sprintf("%s: %v. %v", "datadog result_type metric error", src, err),
+			AlertType: statsd.Error,
+		})
+	}
+
+	err = d.Gauge("request_time", r.TimeTaken, r.filterTags("request_time", tags, recordTags), 1)
+	if err != nil {
+		log.Printf("datadog request_time gauge metric error: %v\n%v", src, err)
+		sendEvent(d, statsd.Event{
+			Title:     "datadog metric error",
+			Text:      fmt.Sprintf("%s: %v. %v", "datadog request_time metric error", src, err),
+			AlertType: statsd.Error,
+		})
+	}
+}
+
+func deleteMessage(d metricClient,
+	q *queue,
+	svc sqsiface.SQSAPI,
 	deleteMessageStream <-chan *string,
 	wg *sync.WaitGroup,
-	aliveDelete chan<- string) {
+	aliveDelete chan<- string,
+	stop <-chan struct{}) {
 	defer wg.Done()
 	for {
 		select {
+		case <-stop:
+			return
 		case msg := <-deleteMessageStream:
 			params := &sqs.DeleteMessageInput{
-				QueueUrl:      &config.SqsQueueURL,
+				QueueUrl:      &q.URL,
 				ReceiptHandle: msg,
 			}
 
@@ -336,10 +732,12 @@ func deleteMessage(d *statsd.Client,
 	}
 }
 
-func heartbeatParse(d *statsd.Client, aliveParser <-chan string, wg *sync.WaitGroup) {
+func heartbeatParse(d metricClient, aliveParser <-chan string, wg *sync.WaitGroup, stop <-chan struct{}) {
 	defer wg.Done()
 	for {
 		select {
+		case <-stop:
+			return
 		case msg := <-aliveParser:
 			sendEvent(d, statsd.Event{
 				Title: "heartbeat parser",
@@ -357,10 +755,12 @@ func heartbeatParse(d *statsd.Client, aliveParser <-chan string, wg *sync.WaitGr
 	}
 }
 
-func heartbeatDelete(d *statsd.Client, aliveDelete <-chan string, wg *sync.WaitGroup) {
+func heartbeatDelete(d metricClient, aliveDelete <-chan string, wg *sync.WaitGroup, stop <-chan struct{}) {
 	defer wg.Done()
 	for {
 		select {
+		case <-stop:
+			return
 		case msg := <-aliveDelete:
 			sendEvent(d, statsd.Event{
 				Title: "heartbeat delete",
@@ -378,7 +778,15 @@ func heartbeatDelete(d *statsd.Client, aliveDelete <-chan string, wg *sync.WaitG
 	}
 }
 
-func sendEvent(d *statsd.Client, e statsd.Event) {
+// reportParseError counts and logs a log record that could not be parsed.
+func reportParseError(d metricClient, format string, tags []string, src interface{}, err error) {
+	log.Printf("parse %s record error: %q\n%v", format, src, err)
+	if err := d.Incr("parse_error", withTags(tags, createTag("format", format)), 1); err != nil {
+		log.Printf("datadog parse_error count metric error: %v", err)
+	}
+}
+
+func sendEvent(d metricClient, e statsd.Event) {
 	// Unfortunately, we can only use Datadog predefined sources. However, if we use a source that is not
 	// in this list, Datadog does not drop the event but rather ignore this invalid source name.
 	e.SourceTypeName = "apps"
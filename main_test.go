@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"os"
+	"strings"
 	"testing"
 
+	statsd "github.com/DataDog/datadog-go/statsd"
 	"github.com/go-test/deep"
 )
 
@@ -137,3 +140,105 @@ func TestAppendTags(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitJSONRecords(t *testing.T) {
+	var data = []struct {
+		body     string
+		expected []string
+	}{
+		{`{"x-edge-location":"SYD1"}`, []string{`{"x-edge-location":"SYD1"}`}},
+		{`[{"x-edge-location":"SYD1"}, {"x-edge-location":"MEL50"}]`, []string{`{"x-edge-location":"SYD1"}`, `{"x-edge-location":"MEL50"}`}},
+		{"{\"x-edge-location\":\"SYD1\"}\n\n{\"x-edge-location\":\"MEL50\"}\n", []string{`{"x-edge-location":"SYD1"}`, `{"x-edge-location":"MEL50"}`}},
+		{`[{"x-edge-location":"SYD1"}`, []string{`[{"x-edge-location":"SYD1"}`}},
+		{`[]`, nil},
+		{"{\n  \"x-edge-location\": \"SYD1\",\n  \"sc-status\": 200\n}\n", []string{"{\n  \"x-edge-location\": \"SYD1\",\n  \"sc-status\": 200\n}"}},
+		{"[\n  {\"x-edge-location\": \"SYD1\"},\n  {\"x-edge-location\": \"MEL50\"}\n]", []string{`{"x-edge-location": "SYD1"}`, `{"x-edge-location": "MEL50"}`}},
+	}
+
+	for _, tt := range data {
+		actual := splitJSONRecords(tt.body)
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("splitJSONRecords(%s): expected %v, actual %v", tt.body, tt.expected, actual)
+		}
+	}
+}
+
+func TestEmitMetrics(t *testing.T) {
+	var out bytes.Buffer
+	d := &printClient{w: &out}
+	for _, body := range []string{benchRecord, `{"c-ip":"1.8.1.160","x-edge-location":"MEL50","x-edge-result-type":"Miss","cs-method":"GET","sc-status":200,"time-taken":"0.5"}`} {
+		if err := processMessage(d, nil, formatJSON, []string{"club_name:dev"}, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A pooled record must not carry anything over from the previous one.
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("emitMetrics: expected 6 metrics, actual %d\n%s", len(lines), out.String())
+	}
+	// Only the tags of the default allowlists are sent.
+	expected := []string{
+		"request:1|c|#club_name:dev,client_ip_source:c-ip,cs_uri_stem:,x_edge_location:MEL50,edge_city:Melbourne,edge_country:AU,edge_continent:OC,edge_region:australia,edge_price_class:all,x_edge_result_type:Miss,cs_method:GET,sc_status:200,query_params:,query_cache_buster:,x_host_header:,cs_protocol:,ssl_protocol:,cs_protocol_version:,cs_host:,browser:,os:,device:,bot:",
+		"result_type:1|c|#club_name:dev,cs_uri_stem:,x_edge_location:MEL50,edge_city:Melbourne,edge_country:AU,edge_continent:OC,edge_region:australia,edge_price_class:all,x_edge_result_type:Miss,sc_status:200,x_edge_response_result_type:,cs_host:",
+		"request_time:0.5|g|#club_name:dev,cs_uri_stem:,x_edge_location:MEL50,edge_city:Melbourne,edge_country:AU,edge_continent:OC,edge_region:australia,edge_price_class:all,x_edge_result_type:Miss,cs_method:GET,sc_status:200,cs_protocol_version:,cs_host:",
+	}
+	if diff := deep.Equal(lines[3:], expected); diff != nil {
+		t.Errorf("emitMetrics: %v", diff)
+	}
+}
+
+func TestParseRecordsW3CErrors(t *testing.T) {
+	var out bytes.Buffer
+	d := &printClient{w: &out}
+	// A bad value is counted as an invalid field, a line with the wrong
+	// number of columns as a parse error.
+	line := strings.Replace(testLogLine, "\t200\t", "\tabc\t", 1)
+	if err := processMessage(d, nil, formatW3C, []string{"club_name:dev"}, line+"\nbroken line\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var errors []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(l, "field_invalid:") || strings.HasPrefix(l, "parse_error:") {
+			errors = append(errors, l)
+		}
+	}
+	expected := []string{
+		"field_invalid:1|c|#club_name:dev,field:sc-status",
+		"parse_error:1|c|#club_name:dev,format:w3c",
+	}
+	if diff := deep.Equal(errors, expected); diff != nil {
+		t.Errorf("parseRecords: %v\n%s", diff, out.String())
+	}
+}
+
+func TestParseRecordsW3CReadError(t *testing.T) {
+	// A message that can't be read is returned as an error so it's retried.
+	body := testLogLine + "\n" + strings.Repeat("a", maxLogLineSize+1)
+	if err := processMessage(nopClient{}, nil, formatW3C, nil, body); err == nil {
+		t.Errorf("processMessage: expected error for a line over %d bytes, actual nil", maxLogLineSize)
+	}
+}
+
+// benchRecord is a typical real-time log record shipped as JSON.
+const benchRecord = `{"timestamp":"1575493351.001","c-ip":"192.0.2.100","time-to-first-byte":"0.001","sc-status":"200","sc-bytes":"392","cs-method":"GET","cs-protocol":"https","cs-host":"d111111abcdef8.cloudfront.net","cs-uri-stem":"/index.html","cs-bytes":"23","x-edge-location":"LAX1-C3","x-edge-request-id":"SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==","x-host-header":"d111111abcdef8.cloudfront.net","time-taken":"0.001","cs-protocol-version":"HTTP/2.0","c-ip-version":"IPv4","cs-user-agent":"Mozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64)","cs-referer":"https://example.com/","cs-cookie":"-","cs-uri-query":"q=1","x-edge-response-result-type":"Hit","x-forwarded-for":"-","ssl-protocol":"TLSv1.2","ssl-cipher":"ECDHE-RSA-AES128-GCM-SHA256","x-edge-result-type":"Hit","fle-encrypted-fields":"-","fle-status":"-","sc-content-type":"text/html","sc-content-len":"78","sc-range-start":"-","sc-range-end":"-","c-port":"11040","x-edge-detailed-result-type":"Hit","c-country":"US","cs-accept-encoding":"gzip","cs-accept":"*/*","cache-behavior-path-pattern":"*","cs-headers-count":"12","cs-header-names":"-","cs-headers":"-"}`
+
+// nopClient discards metrics, so benchmarks only measure the parsing.
+type nopClient struct{}
+
+func (nopClient) Incr(name string, tags []string, rate float64) error                 { return nil }
+func (nopClient) Gauge(name string, value float64, tags []string, rate float64) error { return nil }
+func (nopClient) Count(name string, value int64, tags []string, rate float64) error   { return nil }
+func (nopClient) Event(e *statsd.Event) error                                         { return nil }
+
+func BenchmarkProcessMessage(b *testing.B) {
+	tags := []string{"club_name:dev"}
+	b.SetBytes(int64(len(benchRecord)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := processMessage(nopClient{}, nil, formatJSON, tags, benchRecord); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// msgpackExt is a MessagePack extension value, eg. a fluentd EventTime.
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// msgpackDecoder decodes the subset of MessagePack the Fluentd Forward
+// protocol uses into plain Go values: nil, bool, int64, uint64, float64,
+// string, []byte, []interface{}, map[string]interface{} and msgpackExt.
+// A value is rejected once its strings and binaries, plus
+// msgpackValueSize per value, add up to more than maxSize, or once it nests
+// deeper than msgpackMaxDepth, so a peer can't exhaust memory or the stack.
+type msgpackDecoder struct {
+	r       io.Reader
+	maxSize int
+	// size is what the top level value being decoded has taken so far, and
+	// depth how deeply the current value is nested in it.
+	size  int
+	depth int
+	buf   [8]byte
+}
+
+// msgpackMaxDepth limits how deeply arrays and maps may nest. Fluentd
+// records nest a few levels at most.
+const msgpackMaxDepth = 32
+
+// msgpackValueSize is what a decoded value costs besides its data, roughly
+// the interface holding it.
+const msgpackValueSize = 16
+
+// msgpackReadChunk is the most a string or binary is allocated ahead of its
+// data arriving.
+const msgpackReadChunk = 64 * 1024
+
+func newMsgpackDecoder(r io.Reader, maxSize int) *msgpackDecoder {
+	return &msgpackDecoder{r: r, maxSize: maxSize}
+}
+
+// decode reads the next value. It returns io.EOF only when the stream ends
+// between values.
+func (dec *msgpackDecoder) decode() (interface{}, error) {
+	if dec.depth == 0 {
+		dec.size = 0
+	}
+	if err := dec.grow(msgpackValueSize); err != nil {
+		return nil, err
+	}
+	b, err := dec.read(1)
+	if err != nil {
+		return nil, err
+	}
+	v, err := dec.value(b[0])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (dec *msgpackDecoder) value(c byte) (interface{}, error) {
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return dec.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return dec.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return dec.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := dec.length(c - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return dec.bytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := dec.length(c - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return dec.ext(n)
+	case 0xca:
+		b, err := dec.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := dec.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := dec.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+	case 0xd0:
+		u, err := dec.uint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := dec.uint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := dec.uint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := dec.uint(8)
+		return int64(u), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return dec.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := dec.length(c - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return dec.str(n)
+	case 0xdc, 0xdd:
+		n, err := dec.length(c - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return dec.arrayOf(n)
+	case 0xde, 0xdf:
+		n, err := dec.length(c - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return dec.mapOf(n)
+	}
+	return nil, fmt.Errorf("msgpack: unknown type 0x%02x", c)
+}
+
+func (dec *msgpackDecoder) read(n int) ([]byte, error) {
+	b := dec.buf[:n]
+	_, err := io.ReadFull(dec.r, b)
+	return b, err
+}
+
+func (dec *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := dec.read(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// length reads a 1, 2 or 4 byte length, selected by size 0, 1 or 2.
+func (dec *msgpackDecoder) length(size byte) (int, error) {
+	u, err := dec.uint(1 << size)
+	if err != nil {
+		return 0, err
+	}
+	if u > uint64(dec.maxSize) {
+		return 0, fmt.Errorf("msgpack: length %d exceeds %d", u, dec.maxSize)
+	}
+	return int(u), nil
+}
+
+// grow adds n to the size of the value being decoded.
+func (dec *msgpackDecoder) grow(n int) error {
+	dec.size += n
+	if dec.size > dec.maxSize {
+		return fmt.Errorf("msgpack: value exceeds %d bytes", dec.maxSize)
+	}
+	return nil
+}
+
+// bytes reads n bytes. Long ones are read in chunks, so a length that
+// claims more than the peer sends doesn't allocate it all up front.
+func (dec *msgpackDecoder) bytes(n int) ([]byte, error) {
+	if err := dec.grow(n); err != nil {
+		return nil, err
+	}
+	if n <= msgpackReadChunk {
+		b := make([]byte, n)
+		_, err := io.ReadFull(dec.r, b)
+		return b, err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(dec.r, int64(n)))
+	if err == nil && len(b) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// enter descends into an array or map.
+func (dec *msgpackDecoder) enter() error {
+	dec.depth++
+	if dec.depth > msgpackMaxDepth {
+		return fmt.Errorf("msgpack: values nest deeper than %d", msgpackMaxDepth)
+	}
+	return nil
+}
+
+func (dec *msgpackDecoder) str(n int) (string, error) {
+	b, err := dec.bytes(n)
+	return string(b), err
+}
+
+func (dec *msgpackDecoder) ext(n int) (interface{}, error) {
+	t, err := dec.read(1)
+	if err != nil {
+		return nil, err
+	}
+	typ := int8(t[0])
+	b, err := dec.bytes(n)
+	return msgpackExt{Type: typ, Data: b}, err
+}
+
+func (dec *msgpackDecoder) arrayOf(n int) ([]interface{}, error) {
+	defer func() { dec.depth-- }()
+	if err := dec.enter(); err != nil {
+		return nil, err
+	}
+	a := make([]interface{}, 0, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := dec.decode()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+// mapOf decodes a map. Keys must be strings or binaries, as they are in
+// every fluentd record.
+func (dec *msgpackDecoder) mapOf(n int) (map[string]interface{}, error) {
+	defer func() { dec.depth-- }()
+	if err := dec.enter(); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		k, err := dec.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := dec.decode()
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case string:
+			m[k] = v
+		case []byte:
+			m[string(k)] = v
+		default:
+			return nil, errors.New("msgpack: map key is not a string")
+		}
+	}
+	return m, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// msgpackString encodes s as a MessagePack string.
+func msgpackString(s string) []byte {
+	n := len(s)
+	var b []byte
+	switch {
+	case n < 32:
+		b = []byte{0xa0 | byte(n)}
+	case n < 1<<8:
+		b = []byte{0xd9, byte(n)}
+	case n < 1<<16:
+		b = []byte{0xda, byte(n >> 8), byte(n)}
+	default:
+		b = []byte{0xdb, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// msgpackEncode encodes the values fluentd sends: strings, binaries, ints,
+// arrays and maps.
+func msgpackEncode(v interface{}) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		b = []byte{0xc0}
+	case string:
+		b = msgpackString(v)
+	case []byte:
+		b = append([]byte{0xc5, byte(len(v) >> 8), byte(len(v))}, v...)
+	case int:
+		b = []byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+	case msgpackExt:
+		b = append([]byte{0xd7, byte(v.Type)}, v.Data...)
+	case []interface{}:
+		b = []byte{0xdc, byte(len(v) >> 8), byte(len(v))}
+		for _, e := range v {
+			b = append(b, msgpackEncode(e)...)
+		}
+	case map[string]interface{}:
+		b = []byte{0xde, byte(len(v) >> 8), byte(len(v))}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = append(b, msgpackEncode(k)...)
+			b = append(b, msgpackEncode(v[k])...)
+		}
+	}
+	return b
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	var data = []struct {
+		input    []byte
+		expected interface{}
+	}{
+		{[]byte{0x05}, int64(5)},
+		{[]byte{0xff}, int64(-1)},
+		{[]byte{0xcc, 0xc8}, int64(200)},
+		{[]byte{0xcd, 0x01, 0x00}, int64(256)},
+		{[]byte{0xd0, 0x80}, int64(-128)},
+		{[]byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(18446744073709551615)},
+		{[]byte{0xcb, 0x3f, 0xf2, 0x3d, 0x70, 0xa3, 0xd7, 0x0a, 0x3d}, 1.14},
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{[]byte{0xc0}, nil},
+		{[]byte{0xc3}, true},
+		{[]byte{0xa3, 'S', 'Y', 'D'}, "SYD"},
+		{[]byte{0xd9, 0x03, 'S', 'Y', 'D'}, "SYD"},
+		{[]byte{0xc4, 0x02, 0x01, 0x02}, []byte{0x01, 0x02}},
+		{[]byte{0x92, 0x01, 0xa1, 'a'}, []interface{}{int64(1), "a"}},
+		{[]byte{0x81, 0xa1, 'a', 0x01}, map[string]interface{}{"a": int64(1)}},
+		{[]byte{0xd7, 0x00, 0x5e, 0x10, 0x3c, 0x95, 0x00, 0x00, 0x00, 0x00}, msgpackExt{Type: 0, Data: []byte{0x5e, 0x10, 0x3c, 0x95, 0x00, 0x00, 0x00, 0x00}}},
+		{msgpackEncode(map[string]interface{}{"x-edge-location": "SYD1", "c-ip": []byte("1.8.1.160")}), map[string]interface{}{"x-edge-location": "SYD1", "c-ip": []byte("1.8.1.160")}},
+	}
+
+	for _, tt := range data {
+		actual, err := newMsgpackDecoder(bytes.NewReader(tt.input), 1024).decode()
+		if err != nil {
+			t.Errorf("decode(%x): unexpected error %v", tt.input, err)
+			continue
+		}
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("decode(%x): expected %v, actual %v", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestMsgpackDecodeErrors(t *testing.T) {
+	var data = []struct {
+		input    []byte
+		expected string
+	}{
+		{[]byte{}, "EOF"},
+		{[]byte{0x92, 0x01}, "unexpected EOF"},
+		{[]byte{0xa3, 'S'}, "unexpected EOF"},
+		{[]byte{0xc1}, "unknown type"},
+		{[]byte{0xdb, 0xff, 0xff, 0xff, 0xff}, "exceeds"},
+		{[]byte{0x81, 0x01, 0x01}, "not a string"},
+		// Nested one element arrays, which would overflow the stack.
+		{bytes.Repeat([]byte{0x91}, 1000), "nest deeper"},
+		// 100 strings of 15 bytes are more than 1024 bytes together.
+		{append([]byte{0xdc, 0x00, 0x64}, bytes.Repeat(msgpackString("fifteen bytes!!"), 100)...), "exceeds 1024"},
+	}
+
+	for _, tt := range data {
+		_, err := newMsgpackDecoder(bytes.NewReader(tt.input), 1024).decode()
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("decode(%x): expected %s, actual %v", tt.input, tt.expected, err)
+		}
+	}
+	// A binary claiming more than is sent fails without allocating it all.
+	big := []byte{0xc6, 0x00, 0xff, 0xff, 0xff, 'a'}
+	if _, err := newMsgpackDecoder(bytes.NewReader(big), 1<<26).decode(); err != io.ErrUnexpectedEOF {
+		t.Errorf("decode(%x): expected %v, actual %v", big, io.ErrUnexpectedEOF, err)
+	}
+	if _, err := newMsgpackDecoder(bytes.NewReader(nil), 1024).decode(); err != io.EOF {
+		t.Errorf("decode(): expected %v, actual %v", io.EOF, err)
+	}
+}
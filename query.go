@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	queryOtherDrop = "drop"
+	queryOtherHash = "hash"
+)
+
+// queryRules decide how a record's query string is tagged.
+type queryRules struct {
+	// promote are the parameters tagged with their own tag, tags their tag
+	// names.
+	promote []string
+	tags    []string
+	// hash tags the other parameters with a hash of their sorted names and
+	// values, rather than dropping them.
+	hash bool
+	// cacheBusters are the lower case names of parameters added to defeat
+	// caches.
+	cacheBusters map[string]bool
+	// empty are the tags of records without a query string, which are all
+	// empty like those of other unset fields.
+	empty []string
+}
+
+// queryParams are the rules set by QUERY_TAG_PARAMS, QUERY_OTHER_PARAMS and
+// QUERY_CACHE_BUSTER_PARAMS.
+var queryParams *queryRules
+
+func newQueryRules(promote []string, other string, cacheBusters []string) (*queryRules, error) {
+	q := &queryRules{cacheBusters: make(map[string]bool)}
+	switch other {
+	case queryOtherDrop:
+	case queryOtherHash:
+		q.hash = true
+	default:
+		return nil, fmt.Errorf("unknown QUERY_OTHER_PARAMS %q, expected drop or hash", other)
+	}
+	// A promoted parameter's tag must not clash with the other query tags
+	// nor another promoted parameter's, eg. cache_buster or V and v.
+	seen := map[string]bool{"query_params": true, "query_cache_buster": true}
+	for _, p := range promote {
+		if p = strings.TrimSpace(p); p != "" {
+			tag := queryTagName(p)
+			if seen[tag] {
+				return nil, fmt.Errorf("QUERY_TAG_PARAMS parameter %q is tagged %s, which is already taken", p, tag)
+			}
+			seen[tag] = true
+			q.promote = append(q.promote, p)
+			q.tags = append(q.tags, tag)
+		}
+	}
+	for _, p := range cacheBusters {
+		q.cacheBusters[strings.ToLower(strings.TrimSpace(p))] = true
+	}
+	q.empty = []string{createTag("cs_uri_query", "")}
+	for _, tag := range q.tags {
+		q.empty = append(q.empty, createTag(tag, ""))
+	}
+	q.empty = append(q.empty, createTag("query_params", ""), createTag("query_cache_buster", ""))
+	return q, nil
+}
+
+// queryTagName returns the tag a parameter is promoted to, eg. query_v for
+// v.
+func queryTagName(param string) string {
+	return "query_" + strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '_':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, param)
+}
+
+// appendTags appends the cs_uri_query, promoted parameter, query_params and
+// query_cache_buster tags of the parameters of a query string. The tags are
+// formatted with b.
+func (q *queryRules) appendTags(b *tagBuilder, tags []string, params url.Values) []string {
+	count, cacheBuster := 0, false
+	for name, values := range params {
+		count += len(values)
+		// Cache busters differ on every request, so they are left out of
+		// the hash.
+		if q.cacheBusters[strings.ToLower(name)] {
+			cacheBuster = true
+			delete(params, name)
+		}
+	}
+
+	// cs_uri_query comes first, but can only be set once the promoted
+	// parameters are taken out.
+	n := len(tags)
+	tags = append(tags, "")
+	for i, p := range q.promote {
+		v := ""
+		if values, ok := params[p]; ok {
+			v = values[0]
+			delete(params, p)
+		}
+		tags = b.add(tags, q.tags[i], tagValue(v))
+	}
+	other := ""
+	if q.hash && len(params) > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(params.Encode()))
+		other = fmt.Sprintf("%08x", h.Sum32())
+	}
+	b.set(n, "cs_uri_query", other)
+
+	start := b.begin("query_params")
+	b.buf = strconv.AppendInt(b.buf, int64(count), 10)
+	b.end(len(tags), start)
+	tags = append(tags, "")
+	return b.add(tags, "query_cache_buster", strconv.FormatBool(cacheBuster))
+}
+
+// queryTags appends the tags of a record's query string, which is parsed
+// into its parameters instead of being tagged whole. Parameters that can't
+// be decoded are skipped.
+func queryTags(r *Record, tags []string) []string {
+	if r.URIQuery == "" {
+		return append(tags, queryParams.empty...)
+	}
+	params, _ := url.ParseQuery(r.URIQuery)
+	return queryParams.appendTags(&r.tb, tags, params)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestQueryTags(t *testing.T) {
+	saved := queryParams
+	defer func() { queryParams = saved }()
+
+	var data = []struct {
+		other    string
+		query    string
+		expected []string
+	}{
+		{"drop", "", []string{"cs_uri_query:", "query_format:", "query_utm_source:", "query_params:", "query_cache_buster:"}},
+		{"drop", "format=webp&w=640", []string{"cs_uri_query:", "query_format:webp", "query_utm_source:", "query_params:2", "query_cache_buster:false"}},
+		{"drop", "utm_source=news%2C%20letter&_=1519866123", []string{"cs_uri_query:", "query_format:", "query_utm_source:news_ letter", "query_params:2", "query_cache_buster:true"}},
+		{"hash", "w=640&h=480&format=png", []string{"cs_uri_query:28502a7e", "query_format:png", "query_utm_source:", "query_params:3", "query_cache_buster:false"}},
+		{"hash", "h=480&w=640&CB=7", []string{"cs_uri_query:28502a7e", "query_format:", "query_utm_source:", "query_params:3", "query_cache_buster:true"}},
+		{"hash", "format=png", []string{"cs_uri_query:", "query_format:png", "query_utm_source:", "query_params:1", "query_cache_buster:false"}},
+	}
+
+	for _, tt := range data {
+		var err error
+		if queryParams, err = newQueryRules([]string{"format", " utm_source"}, tt.other, []string{"_", "cb"}); err != nil {
+			t.Fatal(err)
+		}
+		r := &Record{URIQuery: tt.query}
+		actual := r.tb.build(queryTags(r, nil))
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("queryTags(%s) with %s: expected %v, actual %v", tt.query, tt.other, tt.expected, actual)
+		}
+	}
+
+	if _, err := newQueryRules(nil, "keep", nil); err == nil {
+		t.Errorf("newQueryRules(keep): expected error, actual nil")
+	}
+	for _, promote := range [][]string{{"params"}, {"cache-buster"}, {"v", "V"}} {
+		if _, err := newQueryRules(promote, queryOtherDrop, nil); err == nil {
+			t.Errorf("newQueryRules(%v): expected error, actual nil", promote)
+		}
+	}
+}
+
+func TestQueryTagName(t *testing.T) {
+	for param, expected := range map[string]string{"v": "query_v", "utm_source": "query_utm_source", "Page-Size": "query_page_size"} {
+		if actual := queryTagName(param); actual != expected {
+			t.Errorf("queryTagName(%s): expected %s, actual %s", param, expected, actual)
+		}
+	}
+}
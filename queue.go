@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// queue is an SQS queue served by its own receive, parse and delete
+// pipeline. Settings left out of SQS_QUEUES_CONFIG default to the matching
+// environment variables, eg. Region defaults to SQS_REGION.
+type queue struct {
+	// Name is added to every metric as the queue tag. It defaults to the
+	// last segment of the queue URL.
+	Name                string `json:"name"`
+	URL                 string `json:"url"`
+	Region              string `json:"region"`
+	Club                string `json:"club"`
+	Format              string `json:"format"`
+	Encoding            string `json:"encoding"`
+	WaitTimeSeconds     int64  `json:"wait_time_seconds"`
+	MaxNumberOfMessages int64  `json:"max_number_of_messages"`
+	VisibilityTimeout   int64  `json:"visibility_timeout"`
+	GoRoutine           int    `json:"goroutine"`
+	// MinGoRoutine and MaxGoRoutine bound the number of workers the
+	// autoscaler runs, starting from GoRoutine.
+	MinGoRoutine int `json:"min_goroutine"`
+	MaxGoRoutine int `json:"max_goroutine"`
+	// AttributeRules map message attributes to the format and tags of each
+	// message, see attributeRule.
+	AttributeRules []string `json:"attribute_rules"`
+
+	rules []attributeRule
+}
+
+// loadQueues returns the queues listed in SQS_QUEUES_CONFIG, or the single
+// queue set by SQS_QUEUE_URL.
+func loadQueues() ([]*queue, error) {
+	var queues []*queue
+	if config.SqsQueuesConfig != "" {
+		b, err := ioutil.ReadFile(config.SqsQueuesConfig)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &queues); err != nil {
+			return nil, fmt.Errorf("%s: %v", config.SqsQueuesConfig, err)
+		}
+	} else if config.SqsQueueURL != "" {
+		queues = append(queues, &queue{URL: config.SqsQueueURL})
+	}
+
+	names := make(map[string]bool, len(queues))
+	for _, q := range queues {
+		if q.URL == "" {
+			return nil, fmt.Errorf("queue %q has no url", q.Name)
+		}
+		q.setDefaults()
+		if !validFormat(q.Format) {
+			return nil, fmt.Errorf("queue %q has unknown format %q", q.Name, q.Format)
+		}
+		if _, err := parseEncodings(q.Encoding); err != nil {
+			return nil, fmt.Errorf("queue %q has %v", q.Name, err)
+		}
+		if q.MinGoRoutine < 1 || q.MaxGoRoutine < q.MinGoRoutine {
+			return nil, fmt.Errorf("queue %q has invalid goroutine bounds %d-%d", q.Name, q.MinGoRoutine, q.MaxGoRoutine)
+		}
+		rules, err := parseAttributeRules(q.AttributeRules)
+		if err != nil {
+			return nil, fmt.Errorf("queue %q: %v", q.Name, err)
+		}
+		q.rules = rules
+		if names[q.Name] {
+			return nil, fmt.Errorf("queue %q is configured more than once", q.Name)
+		}
+		names[q.Name] = true
+	}
+	return queues, nil
+}
+
+func (q *queue) setDefaults() {
+	if q.Name == "" {
+		q.Name = path.Base(q.URL)
+	}
+	if q.Region == "" {
+		q.Region = config.SqsRegion
+	}
+	if q.Club == "" {
+		q.Club = config.Club
+	}
+	if q.Format == "" {
+		q.Format = config.SqsMessageFormat
+	}
+	if q.Encoding == "" {
+		q.Encoding = config.SqsMessageEncoding
+	}
+	if q.WaitTimeSeconds == 0 {
+		q.WaitTimeSeconds = config.SqsWaitTimeSeconds
+	}
+	if q.MaxNumberOfMessages == 0 {
+		q.MaxNumberOfMessages = config.SqsMaxNumberOfMessages
+	}
+	if q.VisibilityTimeout == 0 {
+		q.VisibilityTimeout = config.SqsVisibilityTimeout
+	}
+	if q.GoRoutine == 0 {
+		q.GoRoutine = config.GoRoutine
+	}
+	if q.MinGoRoutine == 0 {
+		q.MinGoRoutine = config.SqsMinGoRoutine
+	}
+	if q.MinGoRoutine == 0 {
+		q.MinGoRoutine = q.GoRoutine
+	}
+	if q.MaxGoRoutine == 0 {
+		q.MaxGoRoutine = config.SqsMaxGoRoutine
+	}
+	if q.MaxGoRoutine == 0 {
+		q.MaxGoRoutine = q.GoRoutine
+		if q.MinGoRoutine > q.MaxGoRoutine {
+			q.MaxGoRoutine = q.MinGoRoutine
+		}
+	}
+	if q.AttributeRules == nil {
+		q.AttributeRules = config.SqsAttributeRules
+	}
+}
+
+// tags are added to every metric derived from the queue's messages.
+func (q *queue) tags() []string {
+	return appendTags(createTag("club_name", q.Club), createTag("queue", q.Name))
+}
+
+// startQueue starts the receive, parse and delete pipeline of a queue, and
+// its autoscaler when the queue may run more than MinGoRoutine workers.
+func startQueue(d metricClient, q *queue, svc sqsiface.SQSAPI, s3svc s3iface.S3API, wg *sync.WaitGroup) {
+	p := newWorkerPool(d, q, svc, s3svc, wg)
+	p.resize(clampInt(q.GoRoutine, q.MinGoRoutine, q.MaxGoRoutine))
+	if q.MaxGoRoutine > q.MinGoRoutine {
+		wg.Add(1)
+		go p.autoscale(time.Duration(config.SqsAutoscaleInterval) * time.Second)
+	}
+}
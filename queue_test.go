@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestLoadQueues(t *testing.T) {
+	f, err := ioutil.TempFile("", "queues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[
+		{"url": "https://sqs.ap-southeast-2.amazonaws.com/123456789012/cdn-syd", "region": "ap-southeast-2", "club": "syd", "format": "s3", "goroutine": 4, "min_goroutine": 2, "max_goroutine": 8},
+		{"name": "mel", "url": "https://sqs.us-west-2.amazonaws.com/123456789012/cdn-mel", "encoding": "gzip,base64", "visibility_timeout": 60, "attribute_rules": ["distribution=tag:distribution"]}
+	]`)
+	f.Close()
+
+	defer func(path string) { config.SqsQueuesConfig = path }(config.SqsQueuesConfig)
+	config.SqsQueuesConfig = f.Name()
+
+	actual, err := loadQueues()
+	if err != nil {
+		t.Fatalf("loadQueues: unexpected error %v", err)
+	}
+	expected := []*queue{
+		{
+			Name:                "cdn-syd",
+			URL:                 "https://sqs.ap-southeast-2.amazonaws.com/123456789012/cdn-syd",
+			Region:              "ap-southeast-2",
+			Club:                "syd",
+			Format:              "s3",
+			Encoding:            config.SqsMessageEncoding,
+			WaitTimeSeconds:     config.SqsWaitTimeSeconds,
+			MaxNumberOfMessages: config.SqsMaxNumberOfMessages,
+			VisibilityTimeout:   config.SqsVisibilityTimeout,
+			GoRoutine:           4,
+			MinGoRoutine:        2,
+			MaxGoRoutine:        8,
+		},
+		{
+			Name:                "mel",
+			URL:                 "https://sqs.us-west-2.amazonaws.com/123456789012/cdn-mel",
+			Region:              config.SqsRegion,
+			Club:                config.Club,
+			Format:              config.SqsMessageFormat,
+			Encoding:            "gzip,base64",
+			WaitTimeSeconds:     config.SqsWaitTimeSeconds,
+			MaxNumberOfMessages: config.SqsMaxNumberOfMessages,
+			VisibilityTimeout:   60,
+			GoRoutine:           config.GoRoutine,
+			MinGoRoutine:        config.GoRoutine,
+			MaxGoRoutine:        config.GoRoutine,
+			AttributeRules:      []string{"distribution=tag:distribution"},
+		},
+	}
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Errorf("loadQueues: %v", diff)
+	}
+
+	if diff := deep.Equal(actual[1].rules, []attributeRule{{Attribute: "distribution", Target: "tag", Tag: "distribution"}}); diff != nil {
+		t.Errorf("loadQueues: rules %v", diff)
+	}
+
+	tags := actual[0].tags()
+	if diff := deep.Equal(tags, []string{"club_name:syd", "queue:cdn-syd"}); diff != nil {
+		t.Errorf("tags: expected [club_name:syd queue:cdn-syd], actual %v", tags)
+	}
+}
+
+func TestLoadQueuesInvalid(t *testing.T) {
+	var data = []string{
+		`[{"name": "no-url"}]`,
+		`[{"url": "https://foo/bar", "format": "xml"}]`,
+		`[{"url": "https://foo/bar", "encoding": "brotli"}]`,
+		`[{"url": "https://foo/bar", "attribute_rules": ["distribution"]}]`,
+		`[{"url": "https://foo/bar", "min_goroutine": 4, "max_goroutine": 2}]`,
+		`[{"url": "https://foo/bar"}, {"url": "https://foo/bar"}]`,
+		`{"url": "https://foo/bar"}`,
+	}
+
+	defer func(path string) { config.SqsQueuesConfig = path }(config.SqsQueuesConfig)
+	for _, tt := range data {
+		f, err := ioutil.TempFile("", "queues")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(tt)
+		f.Close()
+		config.SqsQueuesConfig = f.Name()
+
+		if _, err := loadQueues(); err == nil {
+			t.Errorf("loadQueues(%s): expected error, actual nil", tt)
+		}
+		os.Remove(f.Name())
+	}
+}
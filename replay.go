@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+)
+
+const replayUsage = `usage: %s replay [flags] [file ...]
+
+Replay reads CloudFront log records from local files, or stdin when no file
+or "-" is given, and emits their metrics like the SQS pipeline does. Files
+ending in .gz or starting with the gzip magic number are decompressed.
+
+`
+
+// replay runs the replay command and returns the process exit code.
+func replay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	format := fs.String("format", "auto", "input format: auto, w3c, json or realtime")
+	speed := fs.Float64("speed", 0, "replay speed relative to the log timestamps, eg. 1 for real time or 10 for ten times faster; 0 replays as fast as possible")
+	dryRun := fs.Bool("dry-run", false, "print metrics to stdout instead of sending them to STATSD_HOST")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, replayUsage, os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "auto" && (!validFormat(*format) || *format == formatS3) {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	var d metricClient
+	if *dryRun {
+		d = &printClient{w: os.Stdout, namespace: config.StatsdPrefix}
+	} else {
+		c, err := statsd.New(config.StatsdHost)
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		defer c.Close()
+		c.Namespace = config.StatsdPrefix
+		d = c
+	}
+
+	// Replayed metrics are sent with the current time, so they are tagged
+	// to tell them apart from live ones.
+	tags := withTags(defaultTags(), createTag("source", "replay"))
+	p := &pacer{speed: *speed}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		n, err := replayFile(d, name, *format, tags, p)
+		if err != nil {
+			log.Printf("replay %s error: %v", name, err)
+			return 1
+		}
+		log.Printf("%s %d %s %s", "replayed", n, "records from", name)
+	}
+	return 0
+}
+
+// replayFile emits the metrics of every record in a file and returns the
+// number of records replayed.
+func replayFile(d metricClient, name, format string, tags []string, p *pacer) (int, error) {
+	var f io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		f = file
+	}
+
+	br := bufio.NewReaderSize(f, 64*1024)
+	if magic, _ := br.Peek(2); strings.HasSuffix(name, ".gz") || (len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		br = bufio.NewReaderSize(gz, 64*1024)
+	}
+
+	if format == "auto" {
+		sample, _ := br.Peek(4096)
+		format = detectFormat(string(sample))
+	}
+
+	n := 0
+	emit := func(r *Record, src interface{}) {
+		p.wait(r)
+		emitMetrics(d, r, tags, nil, src)
+		n++
+	}
+
+	// A W3C log file is read as a whole since its #Fields directive applies
+	// to the lines that follow. Any other format is one message per line.
+	if format == formatW3C {
+		_, err := readLogLines(br, func(raw logRecord) {
+			r := newRecord(raw)
+			emit(r, name)
+			r.release()
+		}, func(line string, err error) {
+			reportParseError(d, formatW3C, tags, line, err)
+		})
+		return n, err
+	}
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		if err := parseRecords(d, nil, format, tags, scanner.Text(), emit); err != nil {
+			log.Printf("replay record error: %q\n%v", scanner.Text(), err)
+		}
+	}
+	return n, scanner.Err()
+}
+
+// detectFormat guesses the format of a file from its first line. Standard
+// logs start with a directive or a date, real-time logs with an epoch
+// timestamp.
+func detectFormat(sample string) string {
+	line := strings.TrimSpace(sample)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(line, "{"), strings.HasPrefix(line, "["):
+		return formatJSON
+	case strings.HasPrefix(line, "#"):
+		return formatW3C
+	}
+	first := strings.SplitN(line, "\t", 2)[0]
+	if _, err := time.Parse("2006-01-02", first); err == nil {
+		return formatW3C
+	}
+	return formatRealtime
+}
+
+// pacer delays records so they are replayed at speed times the rate they
+// were logged at. A zero speed doesn't delay at all.
+type pacer struct {
+	speed float64
+	// start is when the first record was replayed and first when it was
+	// logged.
+	start time.Time
+	first time.Time
+}
+
+func (p *pacer) wait(r *Record) {
+	if p.speed <= 0 || r.Timestamp.IsZero() {
+		return
+	}
+	t := r.Timestamp
+	if p.first.IsZero() {
+		p.start, p.first = time.Now(), t
+		return
+	}
+	offset := time.Duration(float64(t.Sub(p.first)) / p.speed)
+	if wait := time.Until(p.start.Add(offset)); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// printClient writes metrics and events in the dogstatsd datagram format
+// instead of sending them.
+type printClient struct {
+	w         io.Writer
+	namespace string
+
+	mu sync.Mutex
+}
+
+func (c *printClient) Incr(name string, tags []string, rate float64) error {
+	return c.print(name, "1|c", tags)
+}
+
+func (c *printClient) Gauge(name string, value float64, tags []string, rate float64) error {
+	return c.print(name, strconv.FormatFloat(value, 'f', -1, 64)+"|g", tags)
+}
+
+func (c *printClient) Count(name string, value int64, tags []string, rate float64) error {
+	return c.print(name, strconv.FormatInt(value, 10)+"|c", tags)
+}
+
+func (c *printClient) Event(e *statsd.Event) error {
+	s, err := e.Encode()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = fmt.Fprintln(c.w, s)
+	return err
+}
+
+func (c *printClient) print(name, value string, tags []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := fmt.Fprintf(c.w, "%s%s:%s|#%s\n", c.namespace, name, value, strings.Join(tags, ","))
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	var data = []struct {
+		sample   string
+		expected string
+	}{
+		{testLogFile, formatW3C},
+		{testLogLine, formatW3C},
+		{"\n{\"x-edge-location\":\"SYD1\"}\n", formatJSON},
+		{`[{"x-edge-location":"SYD1"}]`, formatJSON},
+		{"1519866123.456\t1.8.1.160\t0.001\t200", formatRealtime},
+	}
+
+	for _, tt := range data {
+		if actual := detectFormat(tt.sample); actual != tt.expected {
+			t.Errorf("detectFormat(%q): expected %v, actual %v", tt.sample, tt.expected, actual)
+		}
+	}
+}
+
+func TestReplayFile(t *testing.T) {
+	var data = []struct {
+		name     string
+		content  string
+		gzip     bool
+		expected int
+	}{
+		{"access.log.gz", testLogFile, true, 2},
+		{"access.log", testLogLine + "\n", false, 1},
+		{"records.jsonl", "{\"x-edge-location\":\"SYD1\"}\n[{\"x-edge-location\":\"MEL50\"},{\"x-edge-location\":\"SYD1\"}]\nnot json\n", false, 3},
+	}
+
+	for _, tt := range data {
+		f, err := ioutil.TempFile("", tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.gzip {
+			gz := gzip.NewWriter(f)
+			gz.Write([]byte(tt.content))
+			gz.Close()
+		} else {
+			f.WriteString(tt.content)
+		}
+		f.Close()
+
+		var buf bytes.Buffer
+		d := &printClient{w: &buf, namespace: "cloudfront."}
+		n, err := replayFile(d, f.Name(), "auto", []string{"club_name:dev"}, &pacer{})
+		os.Remove(f.Name())
+
+		if err != nil {
+			t.Errorf("replayFile(%s): unexpected error %v", tt.name, err)
+		}
+		if n != tt.expected {
+			t.Errorf("replayFile(%s): expected %d records, actual %d", tt.name, tt.expected, n)
+		}
+		// Every record is a request and result_type count and a
+		// request_time gauge.
+		if c := strings.Count(buf.String(), "cloudfront.request:1|c|#club_name:dev,"); c != tt.expected {
+			t.Errorf("replayFile(%s): expected %d request metrics, actual %d", tt.name, tt.expected, c)
+		}
+	}
+}
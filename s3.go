@@ -0,0 +1,110 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type s3Object struct {
+	Bucket string
+	Key    string
+}
+
+// s3EventObjects returns the objects referenced by an S3 event notification.
+// S3 sends an s3:TestEvent without any records when a notification is first
+// configured, in which case no objects and no error are returned.
+func s3EventObjects(msg string) ([]s3Object, error) {
+	if !gjson.Valid(msg) {
+		return nil, fmt.Errorf("S3 event is not valid JSON")
+	}
+	if gjson.Get(msg, "Event").String() == "s3:TestEvent" {
+		return nil, nil
+	}
+
+	records := gjson.Get(msg, "Records")
+	if !records.IsArray() {
+		return nil, fmt.Errorf("S3 event has no Records")
+	}
+
+	var objects []s3Object
+	for _, r := range records.Array() {
+		if !strings.HasPrefix(r.Get("eventName").String(), "ObjectCreated:") {
+			continue
+		}
+		// Object keys in S3 notifications are URL encoded, with spaces
+		// encoded as "+".
+		key, err := url.QueryUnescape(r.Get("s3.object.key").String())
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, s3Object{
+			Bucket: r.Get("s3.bucket.name").String(),
+			Key:    key,
+		})
+	}
+	return objects, nil
+}
+
+// processS3Event fetches every log object referenced by an S3 event
+// notification and calls fn for each of its lines. An error is returned as
+// soon as one object can't be processed so the message can be retried.
+// Nothing records how far processing got, so a retry calls fn again for the
+// lines read before the error.
+func processS3Event(svc s3iface.S3API, msg string, fn recordFunc, onErr lineErrFunc) error {
+	objects, err := s3EventObjects(msg)
+	if err != nil {
+		return err
+	}
+	if svc == nil && len(objects) > 0 {
+		return fmt.Errorf("no S3 client to fetch %d objects", len(objects))
+	}
+
+	for _, o := range objects {
+		log.Printf("%s s3://%s/%s", "process S3 object", o.Bucket, o.Key)
+		n, err := processS3Object(svc, o, func(raw logRecord) {
+			r := newRecord(raw)
+			fn(r, o.Key)
+			r.release()
+		}, onErr)
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s: %v", o.Bucket, o.Key, err)
+		}
+		log.Printf("%s %d %s s3://%s/%s", "processed", n, "lines from", o.Bucket, o.Key)
+	}
+	return nil
+}
+
+// processS3Object streams a CloudFront log object from S3, decompressing it
+// when needed, and calls fn for every log line and onErr for every line that
+// could not be parsed. It returns the number of lines processed.
+func processS3Object(svc s3iface.S3API, o s3Object, fn func(logRecord), onErr lineErrFunc) (int, error) {
+	resp, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    aws.String(o.Key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(o.Key, ".gz") || aws.StringValue(resp.ContentEncoding) == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return readLogLines(body, fn, onErr)
+}
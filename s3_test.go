@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/go-test/deep"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const testLogFile = "#Version: 1.0\n" +
+	"#Fields: date time x-edge-location sc-bytes c-ip cs-method cs(Host) cs-uri-stem sc-status\n" +
+	"2018-03-01\t01:02:03\tSYD1\t1045619\t1.8.1.160\tGET\td111111abcdef8.cloudfront.net\t/8d41/2015/01/22/00.bin\t200\n" +
+	"2018-03-01\t01:02:04\tMEL50\t0\t1.8.1.161\tGET\td111111abcdef8.cloudfront.net\t/index.html\t404\n"
+
+type fakeS3 struct {
+	s3iface.S3API
+	body []byte
+}
+
+func (f *fakeS3) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(f.body))}, nil
+}
+
+func TestS3EventObjects(t *testing.T) {
+	var data = []struct {
+		msg      string
+		expected []s3Object
+	}{
+		{`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"cf/E2ABC.2018-03-01-01.a1b2c3.gz"}}}]}`,
+			[]s3Object{{"logs", "cf/E2ABC.2018-03-01-01.a1b2c3.gz"}}},
+		{`{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"my+logs/E2ABC.gz"}}},{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"logs"},"object":{"key":"E2ABC.gz"}}}]}`,
+			[]s3Object{{"logs", "my logs/E2ABC.gz"}}},
+		{`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"logs"}`, nil},
+	}
+
+	for _, tt := range data {
+		actual, err := s3EventObjects(tt.msg)
+		if err != nil {
+			t.Errorf("s3EventObjects(%s): unexpected error %v", tt.msg, err)
+		}
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("s3EventObjects(%s): expected %v, actual %v", tt.msg, tt.expected, actual)
+		}
+	}
+
+	for _, msg := range []string{`{"Records":`, `{"foo":"bar"}`} {
+		if _, err := s3EventObjects(msg); err == nil {
+			t.Errorf("s3EventObjects(%s): expected error, actual nil", msg)
+		}
+	}
+}
+
+func TestProcessS3Object(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(testLogFile))
+	gz.Close()
+
+	var locations []string
+	n, err := processS3Object(&fakeS3{body: buf.Bytes()}, s3Object{"logs", "E2ABC.2018-03-01-01.a1b2c3.gz"}, func(r logRecord) {
+		locations = append(locations, r["x-edge-location"])
+	}, func(line string, err error) {
+		t.Errorf("processS3Object: unexpected error %q %v", line, err)
+	})
+	if err != nil {
+		t.Fatalf("processS3Object: unexpected error %v", err)
+	}
+	if diff := deep.Equal(locations, []string{"SYD1", "MEL50"}); diff != nil || n != 2 {
+		t.Errorf("processS3Object: expected [SYD1 MEL50], actual %v", locations)
+	}
+}
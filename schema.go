@@ -0,0 +1,464 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type fieldType string
+
+const (
+	fieldString    fieldType = "string"
+	fieldInt       fieldType = "int"
+	fieldFloat     fieldType = "float"
+	fieldTimestamp fieldType = "timestamp"
+	fieldIP        fieldType = "ip"
+)
+
+// Record is a CloudFront log record decoded by the schema. Every parser
+// produces a logRecord keyed by whatever field names its input uses, which
+// newRecord turns into a Record for the rest of the pipeline.
+type Record struct {
+	// Timestamp is when the request was logged: the real-time log
+	// timestamp, or the standard log date and time.
+	Timestamp time.Time
+	Date      string
+	Time      string
+
+	ClientIP     net.IP
+	ClientPort   int64
+	ForwardedFor string
+	// Client is the address of the client that made the request, resolved
+	// from ClientIP and ForwardedFor, and ClientSource where it came from:
+	// "c-ip" or "x-forwarded-for".
+	Client       net.IP
+	ClientSource string
+
+	Method          string
+	Protocol        string
+	ProtocolVersion string
+	Host            string
+	HostHeader      string
+	URIStem         string
+	URIQuery        string
+	UserAgent       string
+	Referer         string
+	Cookie          string
+	BytesReceived   int64
+
+	Status        int64
+	BytesSent     int64
+	ContentType   string
+	ContentLength int64
+	RangeStart    int64
+	RangeEnd      int64
+
+	TimeTaken       float64
+	TimeToFirstByte float64
+
+	EdgeLocation           string
+	EdgeRequestID          string
+	EdgeResultType         string
+	EdgeResponseResultType string
+	EdgeDetailedResultType string
+
+	SSLProtocol        string
+	SSLCipher          string
+	FLEStatus          string
+	FLEEncryptedFields int64
+
+	// Invalid lists the fields whose value could not be converted to the
+	// field's type, which are left unset, or is not one of its enum values.
+	Invalid []string
+	// Missing lists the required fields the record doesn't have.
+	Missing []string
+
+	// present has bit i set when schema[i] is set.
+	present uint64
+
+	// values holds the raw value of every schema field while the record is
+	// decoded, and fromKey has bit i set when schema[i] was read from its
+	// key rather than an alias. keys are the keys the record arrived with.
+	values  []string
+	fromKey uint64
+	keys    []string
+	// tagBuf is the buffer metricTags builds tags in, and metricBuf the one
+	// filterTags picks the tags of a metric in. tb formats the tags that
+	// differ from record to record.
+	tagBuf    []string
+	metricBuf []string
+	tb        tagBuilder
+}
+
+// tagBuilder formats the tags of a record into a single buffer, which is
+// converted to a string once all of them are added, rather than allocating
+// a string per tag.
+type tagBuilder struct {
+	buf   []byte
+	spans []tagSpan
+}
+
+// tagSpan locates the tag at index i of a record's tags in tagBuilder.buf.
+type tagSpan struct {
+	i, start, end int
+}
+
+// add appends the tag k:v to tags. The tag stays empty until build.
+func (b *tagBuilder) add(tags []string, k, v string) []string {
+	b.set(len(tags), k, v)
+	return append(tags, "")
+}
+
+// set formats the tag k:v as the tag at index i.
+func (b *tagBuilder) set(i int, k, v string) {
+	start := b.begin(k)
+	b.buf = append(b.buf, v...)
+	b.end(i, start)
+}
+
+// begin starts formatting a tag named k, whose value is appended to buf
+// before the tag is ended. It returns where the tag starts.
+func (b *tagBuilder) begin(k string) int {
+	start := len(b.buf)
+	b.buf = append(b.buf, k...)
+	b.buf = append(b.buf, ':')
+	return start
+}
+
+// end makes the tag started at start the tag at index i.
+func (b *tagBuilder) end(i, start int) {
+	b.spans = append(b.spans, tagSpan{i, start, len(b.buf)})
+}
+
+// build fills in the tags added since the last build and returns tags.
+func (b *tagBuilder) build(tags []string) []string {
+	s := string(b.buf)
+	for _, sp := range b.spans {
+		tags[sp.i] = s[sp.start:sp.end]
+	}
+	b.buf, b.spans = b.buf[:0], b.spans[:0]
+	return tags
+}
+
+// fieldSpec declares a log field: the key parsers produce it under, other
+// keys it may arrive as, eg. from shippers using older names, its type and
+// the Record field it is decoded into. Fields with a tag are added to every
+// request metric, and fields with derive add the tags it returns instead.
+// Records without a required field, or with a value outside a field's enum,
+// are still processed but counted, see reportFieldErrors.
+type fieldSpec struct {
+	Key      string
+	Aliases  []string
+	Type     fieldType
+	Tag      string
+	Required bool
+	Enum     []string
+	// derive appends tags computed from the field to tags.
+	derive func(r *Record, tags []string) []string
+	// ref returns a pointer to the Record field, whose type must match
+	// Type, which decides how values are converted: *string, *int64,
+	// *float64, *time.Time or *net.IP.
+	ref func(r *Record) interface{}
+}
+
+// resultTypes are the values of x-edge-result-type and
+// x-edge-response-result-type.
+var resultTypes = []string{"Hit", "RefreshHit", "Miss", "LimitExceeded", "CapacityExceeded", "Error", "Redirect", "LambdaGeneratedResponse", "FunctionGeneratedResponse"}
+
+// schema lists the CloudFront log fields we read. Tagged fields are in the
+// order their tags are added to metrics.
+var schema = []fieldSpec{
+	{Key: "c-ip", Type: fieldIP, Required: true, Tag: "c_ip", derive: clientTags, ref: func(r *Record) interface{} { return &r.ClientIP }},
+	{Key: "time-taken", Type: fieldFloat, Required: true, Tag: "time_taken", ref: func(r *Record) interface{} { return &r.TimeTaken }},
+	// Stems are tagged as route templates, see uriTags.
+	{Key: "cs-uri-stem", Type: fieldString, derive: uriTags, ref: func(r *Record) interface{} { return &r.URIStem }},
+	{Key: "x-edge-location", Type: fieldString, Required: true, Tag: "x_edge_location", derive: edgeTags, ref: func(r *Record) interface{} { return &r.EdgeLocation }},
+	{Key: "x-edge-result-type", Type: fieldString, Required: true, Enum: resultTypes, Tag: "x_edge_result_type", ref: func(r *Record) interface{} { return &r.EdgeResultType }},
+	{Key: "date", Type: fieldString, Tag: "date", ref: func(r *Record) interface{} { return &r.Date }},
+	{Key: "time", Type: fieldString, Tag: "time", ref: func(r *Record) interface{} { return &r.Time }},
+	{Key: "cs-method", Type: fieldString, Required: true, Enum: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE"}, Tag: "cs_method", ref: func(r *Record) interface{} { return &r.Method }},
+	{Key: "sc-status", Type: fieldInt, Required: true, Tag: "sc_status", ref: func(r *Record) interface{} { return &r.Status }},
+	// Query strings are tagged by their parameters, see queryTags.
+	{Key: "cs-uri-query", Type: fieldString, derive: queryTags, ref: func(r *Record) interface{} { return &r.URIQuery }},
+	{Key: "x-edge-request-id", Type: fieldString, Tag: "x_edge_request_id", ref: func(r *Record) interface{} { return &r.EdgeRequestID }},
+	{Key: "x-host-header", Type: fieldString, Tag: "x_host_header", ref: func(r *Record) interface{} { return &r.HostHeader }},
+	{Key: "cs-protocol", Type: fieldString, Enum: []string{"http", "https", "ws", "wss", "grpcs"}, Tag: "cs_protocol", ref: func(r *Record) interface{} { return &r.Protocol }},
+	{Key: "x-forwarded-for", Type: fieldString, Tag: "x_forwarded_for", ref: func(r *Record) interface{} { return &r.ForwardedFor }},
+	{Key: "ssl-protocol", Type: fieldString, Enum: []string{"SSLv3", "TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}, Tag: "ssl_protocol", ref: func(r *Record) interface{} { return &r.SSLProtocol }},
+	// Records used to be read from "ssl_cipher", which CloudFront never
+	// writes.
+	{Key: "ssl-cipher", Aliases: []string{"ssl_cipher"}, Type: fieldString, Tag: "ssl_cipher", ref: func(r *Record) interface{} { return &r.SSLCipher }},
+	{Key: "x-edge-response-result-type", Type: fieldString, Enum: resultTypes, Tag: "x_edge_response_result_type", ref: func(r *Record) interface{} { return &r.EdgeResponseResultType }},
+	{Key: "cs-protocol-version", Type: fieldString, Tag: "cs_protocol_version", ref: func(r *Record) interface{} { return &r.ProtocolVersion }},
+	{Key: "fle-status", Type: fieldString, Tag: "fle_status", ref: func(r *Record) interface{} { return &r.FLEStatus }},
+	{Key: "fle-encrypted-fields", Type: fieldInt, Tag: "fle_encrypted_fields", ref: func(r *Record) interface{} { return &r.FLEEncryptedFields }},
+	{Key: "cs(Host)", Aliases: []string{"cs-host"}, Type: fieldString, Tag: "cs_host", ref: func(r *Record) interface{} { return &r.Host }},
+	// The raw User-Agent has too many values to be useful as a tag.
+	{Key: "cs(User-Agent)", Aliases: []string{"cs-user-agent"}, Type: fieldString, derive: userAgentTags, ref: func(r *Record) interface{} { return &r.UserAgent }},
+	{Key: "timestamp", Type: fieldTimestamp, ref: func(r *Record) interface{} { return &r.Timestamp }},
+	{Key: "sc-bytes", Type: fieldInt, ref: func(r *Record) interface{} { return &r.BytesSent }},
+	{Key: "cs-bytes", Type: fieldInt, ref: func(r *Record) interface{} { return &r.BytesReceived }},
+	{Key: "time-to-first-byte", Type: fieldFloat, ref: func(r *Record) interface{} { return &r.TimeToFirstByte }},
+	{Key: "x-edge-detailed-result-type", Type: fieldString, ref: func(r *Record) interface{} { return &r.EdgeDetailedResultType }},
+	{Key: "sc-content-type", Type: fieldString, ref: func(r *Record) interface{} { return &r.ContentType }},
+	{Key: "sc-content-len", Type: fieldInt, ref: func(r *Record) interface{} { return &r.ContentLength }},
+	{Key: "sc-range-start", Type: fieldInt, ref: func(r *Record) interface{} { return &r.RangeStart }},
+	{Key: "sc-range-end", Type: fieldInt, ref: func(r *Record) interface{} { return &r.RangeEnd }},
+	{Key: "c-port", Type: fieldInt, ref: func(r *Record) interface{} { return &r.ClientPort }},
+	{Key: "cs(Referer)", Aliases: []string{"cs-referer"}, Type: fieldString, ref: func(r *Record) interface{} { return &r.Referer }},
+	{Key: "cs(Cookie)", Aliases: []string{"cs-cookie"}, Type: fieldString, ref: func(r *Record) interface{} { return &r.Cookie }},
+}
+
+// schemaRef is the schema field a key is read into.
+type schemaRef struct {
+	field int
+	alias bool
+}
+
+// schemaIndex maps the key and aliases of every schema field to the field,
+// so a record is matched against the schema in a single pass over its keys.
+var schemaIndex = func() map[string]schemaRef {
+	index := make(map[string]schemaRef)
+	for i, f := range schema {
+		index[f.Key] = schemaRef{field: i}
+		for _, a := range f.Aliases {
+			index[a] = schemaRef{field: i, alias: true}
+		}
+	}
+	return index
+}()
+
+// emptyTags are the tags of unset fields, which are the same for every
+// record.
+var emptyTags = func() []string {
+	tags := make([]string, len(schema))
+	for i, f := range schema {
+		if f.Tag != "" {
+			tags[i] = createTag(f.Tag, "")
+		}
+	}
+	return tags
+}()
+
+// recordPool recycles Records along with the buffers they are decoded and
+// tagged in. Millions of records an hour are decoded just to send a few
+// metrics each, so allocating a Record and its tags per record adds up.
+var recordPool = sync.Pool{
+	New: func() interface{} {
+		return &Record{values: make([]string, len(schema))}
+	},
+}
+
+// newRecord decodes and validates a raw record. A standard log record's
+// Timestamp comes from its date and time. The record should be released
+// once it has been processed.
+func newRecord(raw logRecord) *Record {
+	r := recordPool.Get().(*Record)
+	for k, v := range raw {
+		r.add(k, v)
+	}
+	r.decode()
+	return r
+}
+
+// newJSONRecord decodes and validates a JSON log record, as produced by
+// fluent-plugin-cloudfront-log, in a single pass over its top level fields
+// without building a logRecord first.
+func newJSONRecord(msg string) *Record {
+	r := recordPool.Get().(*Record)
+	gjson.Parse(msg).ForEach(func(k, v gjson.Result) bool {
+		// Numbers are kept as written, which saves formatting them.
+		if v.Type == gjson.Number {
+			r.add(k.String(), v.Raw)
+		} else {
+			r.add(k.String(), v.String())
+		}
+		return true
+	})
+	r.decode()
+	return r
+}
+
+// add sets the raw value of the field key is the key or an alias of. A
+// field's key takes precedence over its aliases, and a "-" is CloudFront's
+// empty value.
+func (r *Record) add(key, v string) {
+	r.keys = append(r.keys, key)
+	ref, ok := schemaIndex[key]
+	if !ok || v == "" || v == "-" {
+		return
+	}
+	bit := uint64(1) << uint(ref.field)
+	if ref.alias {
+		if r.fromKey&bit != 0 || r.values[ref.field] != "" {
+			return
+		}
+	} else {
+		r.fromKey |= bit
+	}
+	r.values[ref.field] = v
+}
+
+// decode converts the raw values added to r.
+func (r *Record) decode() {
+	drift.observe(r.keys, time.Now())
+
+	for i := range schema {
+		f := &schema[i]
+		v := r.values[i]
+		if v == "" {
+			if f.Required {
+				r.Missing = append(r.Missing, f.Key)
+			}
+			continue
+		}
+		if !f.set(r, v) {
+			r.Invalid = append(r.Invalid, f.Key)
+			continue
+		}
+		if f.Enum != nil && !contains(f.Enum, v) {
+			r.Invalid = append(r.Invalid, f.Key)
+		}
+		r.present |= 1 << uint(i)
+	}
+	if r.Timestamp.IsZero() && r.Date != "" && r.Time != "" {
+		if t, err := time.Parse("2006-01-02 15:04:05", r.Date+" "+r.Time); err == nil {
+			r.Timestamp = t
+		}
+	}
+	r.Client, r.ClientSource = resolveClientIP(r.ClientIP, r.ForwardedFor)
+}
+
+// release puts r back in the pool. Neither r nor the tags metricTags
+// returned for it may be used afterwards.
+func (r *Record) release() {
+	*r = Record{
+		values:    clearStrings(r.values),
+		keys:      clearStrings(r.keys)[:0],
+		tagBuf:    clearStrings(r.tagBuf)[:0],
+		metricBuf: clearStrings(r.metricBuf)[:0],
+		tb:        tagBuilder{buf: r.tb.buf[:0], spans: r.tb.spans[:0]},
+	}
+	recordPool.Put(r)
+}
+
+// clearStrings empties every string of s, so a pooled buffer doesn't keep
+// the messages they point into alive.
+func clearStrings(s []string) []string {
+	for i := range s {
+		s[i] = ""
+	}
+	return s
+}
+
+// set converts v to the field's Type and stores it in r. It reports whether
+// v was valid.
+func (f *fieldSpec) set(r *Record, v string) bool {
+	switch f.Type {
+	case fieldString:
+		*f.ref(r).(*string) = v
+	case fieldInt:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return false
+		}
+		*f.ref(r).(*int64) = n
+	case fieldFloat:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		*f.ref(r).(*float64) = n
+	case fieldIP:
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return false
+		}
+		*f.ref(r).(*net.IP) = ip
+	case fieldTimestamp:
+		ts, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		*f.ref(r).(*time.Time) = time.Unix(0, int64(ts*float64(time.Second))).UTC()
+	default:
+		return false
+	}
+	return true
+}
+
+// has reports whether the field at schema index i is set.
+func (r *Record) has(i int) bool {
+	return r.present&(1<<uint(i)) != 0
+}
+
+// value formats the field at schema index i as a tag value, or "" when it
+// is unset.
+func (r *Record) value(i int) string {
+	if !r.has(i) {
+		return ""
+	}
+	if f := &schema[i]; f.Type == fieldString {
+		return *f.ref(r).(*string)
+	}
+	return string(r.appendValue(nil, i))
+}
+
+// appendValue appends the field at schema index i formatted as a tag value
+// to b. The field must be set.
+func (r *Record) appendValue(b []byte, i int) []byte {
+	f := &schema[i]
+	switch f.Type {
+	case fieldString:
+		return append(b, *f.ref(r).(*string)...)
+	case fieldInt:
+		return strconv.AppendInt(b, *f.ref(r).(*int64), 10)
+	case fieldFloat:
+		return strconv.AppendFloat(b, *f.ref(r).(*float64), 'G', -1, 32)
+	case fieldIP:
+		return append(b, f.ref(r).(*net.IP).String()...)
+	case fieldTimestamp:
+		return f.ref(r).(*time.Time).AppendFormat(b, time.RFC3339Nano)
+	}
+	return b
+}
+
+// tags returns the tags of the record's tagged and derived fields.
+func (r *Record) tags() []string {
+	return append([]string(nil), r.metricTags()...)
+}
+
+// metricTags returns the tags of the record's tagged and derived fields.
+// Each tag is only formatted once, into buffers owned by r, and the metrics
+// pick theirs with filterTags.
+func (r *Record) metricTags() []string {
+	tags := r.tagBuf[:0]
+	for i, f := range schema {
+		if f.Tag != "" {
+			if r.has(i) {
+				start := r.tb.begin(f.Tag)
+				r.tb.buf = r.appendValue(r.tb.buf, i)
+				r.tb.end(len(tags), start)
+			}
+			tags = append(tags, emptyTags[i])
+		}
+		if f.derive != nil {
+			tags = f.derive(r, tags)
+		}
+	}
+	r.tagBuf = r.tb.build(tags)
+	return r.tagBuf
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/tidwall/gjson"
+)
+
+// TestSchemaRefTypes checks every field's ref points to a field of its
+// Type, since set and value convert by Type and would panic otherwise.
+func TestSchemaRefTypes(t *testing.T) {
+	keys := make(map[string]bool)
+	for _, f := range schema {
+		var expected fieldType
+		switch f.ref(&Record{}).(type) {
+		case *string:
+			expected = fieldString
+		case *int64:
+			expected = fieldInt
+		case *float64:
+			expected = fieldFloat
+		case *time.Time:
+			expected = fieldTimestamp
+		case *net.IP:
+			expected = fieldIP
+		}
+		if f.Type != expected {
+			t.Errorf("schema %s: expected type %s, actual %s", f.Key, expected, f.Type)
+		}
+		for _, k := range append([]string{f.Key}, f.Aliases...) {
+			if keys[k] {
+				t.Errorf("schema %s: key %s is declared twice", f.Key, k)
+			}
+			keys[k] = true
+		}
+	}
+	if len(schema) > 64 {
+		t.Errorf("schema: %d fields don't fit in Record.present", len(schema))
+	}
+}
+
+func TestNewRecord(t *testing.T) {
+	line := "2019-12-04\t21:02:31\tLAX1-C3\t392\t192.0.2.100\tGET\td111111abcdef8.cloudfront.net\t/index.html\t200\thttps://example.com/\tMozilla/5.0\tq=1\tsession=abc\tHit\tSOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==\td111111abcdef8.cloudfront.net\thttps\t23\t0.001\t-\tTLSv1.2\tECDHE-RSA-AES128-GCM-SHA256\tHit\tHTTP/2.0\t-\t-\t11040\t0.001\tHit\ttext/html\t78\t-\t-"
+	raw, err := newW3CParser().parseLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := newRecord(raw)
+	expected := &Record{
+		Timestamp:              time.Date(2019, 12, 4, 21, 2, 31, 0, time.UTC),
+		Date:                   "2019-12-04",
+		Time:                   "21:02:31",
+		ClientIP:               net.ParseIP("192.0.2.100"),
+		ClientPort:             11040,
+		Client:                 net.ParseIP("192.0.2.100"),
+		ClientSource:           "c-ip",
+		Method:                 "GET",
+		Protocol:               "https",
+		ProtocolVersion:        "HTTP/2.0",
+		Host:                   "d111111abcdef8.cloudfront.net",
+		HostHeader:             "d111111abcdef8.cloudfront.net",
+		URIStem:                "/index.html",
+		URIQuery:               "q=1",
+		UserAgent:              "Mozilla/5.0",
+		Referer:                "https://example.com/",
+		Cookie:                 "session=abc",
+		BytesReceived:          23,
+		Status:                 200,
+		BytesSent:              392,
+		ContentType:            "text/html",
+		ContentLength:          78,
+		TimeTaken:              0.001,
+		TimeToFirstByte:        0.001,
+		EdgeLocation:           "LAX1-C3",
+		EdgeRequestID:          "SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==",
+		EdgeResultType:         "Hit",
+		EdgeResponseResultType: "Hit",
+		EdgeDetailedResultType: "Hit",
+		SSLProtocol:            "TLSv1.2",
+		SSLCipher:              "ECDHE-RSA-AES128-GCM-SHA256",
+	}
+	expected.present = actual.present
+	if diff := deep.Equal(actual, expected); diff != nil {
+		t.Errorf("newRecord: %v", diff)
+	}
+	if actual.has(fieldIndex("sc-range-start")) || actual.has(fieldIndex("x-forwarded-for")) {
+		t.Errorf("newRecord: expected - fields to be unset")
+	}
+	if actual.Invalid != nil {
+		t.Errorf("newRecord: expected no invalid fields, actual %v", actual.Invalid)
+	}
+}
+
+func TestNewRecordValues(t *testing.T) {
+	var data = []struct {
+		raw       logRecord
+		timestamp time.Time
+		tags      []string
+		invalid   []string
+	}{
+		{
+			logRecord{"date": "2018-03-01", "time": "01:02:03"},
+			time.Date(2018, 3, 1, 1, 2, 3, 0, time.UTC),
+			[]string{"date:2018-03-01", "time:01:02:03"},
+			nil,
+		},
+		{
+			logRecord{"timestamp": "1519866123.5", "date": "2018-03-01", "time": "01:02:03"},
+			time.Date(2018, 3, 1, 1, 2, 3, 5e8, time.UTC),
+			[]string{"date:2018-03-01", "time:01:02:03"},
+			nil,
+		},
+		{
+			logRecord{"c-ip": "1.8.1.160", "ssl_cipher": "ECDHE-RSA-AES128-GCM-SHA256", "cs-host": "cdn.example.com", "sc-status": "304", "time-taken": "1.14"},
+			time.Time{},
+			[]string{"c_ip:1.8.1.160", "client_ip_source:c-ip", "time_taken:1.14", "sc_status:304", "ssl_cipher:ECDHE-RSA-AES128-GCM-SHA256", "cs_host:cdn.example.com"},
+			nil,
+		},
+		{
+			logRecord{"c-ip": "not an ip", "sc-status": "OK", "time-taken": "-", "timestamp": "yesterday"},
+			time.Time{},
+			nil,
+			[]string{"c-ip", "sc-status", "timestamp"},
+		},
+	}
+
+	for _, tt := range data {
+		r := newRecord(tt.raw)
+		if !r.Timestamp.Equal(tt.timestamp) {
+			t.Errorf("newRecord(%v): expected timestamp %v, actual %v", tt.raw, tt.timestamp, r.Timestamp)
+		}
+		var tags []string
+		for _, tag := range r.tags() {
+			if !strings.HasSuffix(tag, ":") {
+				tags = append(tags, tag)
+			}
+		}
+		if diff := deep.Equal(tags, tt.tags); diff != nil {
+			t.Errorf("newRecord(%v): expected tags %v, actual %v", tt.raw, tt.tags, tags)
+		}
+		if diff := deep.Equal(r.Invalid, tt.invalid); diff != nil {
+			t.Errorf("newRecord(%v): expected invalid %v, actual %v", tt.raw, tt.invalid, r.Invalid)
+		}
+	}
+}
+
+func fieldIndex(key string) int {
+	for i, f := range schema {
+		if f.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestNewJSONRecord(t *testing.T) {
+	var data = []string{
+		`{"c-ip":"192.0.2.100","sc-status":200,"time-taken":"0.001","x-edge-location":"LAX1-C3","cs-referer":"https://example.com/"}`,
+		`{"ssl-cipher":"ECDHE-RSA-AES128-GCM-SHA256","ssl_cipher":"RC4-MD5","cs-method":"BREW","fle-status":"-","extra":{"a":1}}`,
+	}
+
+	for _, msg := range data {
+		raw := logRecord{}
+		gjson.Parse(msg).ForEach(func(k, v gjson.Result) bool {
+			raw[k.String()] = v.String()
+			return true
+		})
+		expected := newRecord(raw)
+		actual := newJSONRecord(msg)
+		if diff := deep.Equal(actual, expected); diff != nil {
+			t.Errorf("newJSONRecord(%s): %v", msg, diff)
+		}
+		if actual.present != expected.present {
+			t.Errorf("newJSONRecord(%s): expected fields %b, actual %b", msg, expected.present, actual.present)
+		}
+		expected.release()
+		actual.release()
+	}
+}
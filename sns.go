@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tidwall/gjson"
+)
+
+// snsCert verifies the signature of SNS envelopes when set. It is loaded from
+// SNS_SIGNING_CERT at startup.
+var snsCert *x509.Certificate
+
+// snsEnvelope is an SNS notification as delivered to an SQS queue subscribed
+// without raw message delivery.
+type snsEnvelope struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+}
+
+func loadSNSCertificate(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM certificate found", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// isSNSEnvelope reports whether msg is an SNS notification envelope rather
+// than a log record.
+func isSNSEnvelope(msg string) bool {
+	return gjson.Get(msg, "Type").String() == "Notification" &&
+		gjson.Get(msg, "TopicArn").Exists() &&
+		gjson.Get(msg, "Message").Exists()
+}
+
+// isS3Event reports whether msg is an S3 event notification.
+func isS3Event(msg string) bool {
+	return gjson.Get(msg, "Records.0.s3").Exists() ||
+		gjson.Get(msg, "Event").String() == "s3:TestEvent"
+}
+
+// checkSNSEnvelope returns an error for an SQS message that isn't an SNS
+// envelope while envelopes are verified with cert. Otherwise anyone able to
+// send to the queue could skip verification by not wrapping the message.
+func checkSNSEnvelope(msg string, cert *x509.Certificate) error {
+	if cert != nil && !isSNSEnvelope(msg) {
+		return fmt.Errorf("%s", "message is not an SNS envelope, which SNS_SIGNING_CERT requires")
+	}
+	return nil
+}
+
+// unwrapSNS returns the message carried by an SNS envelope. The signature is
+// verified first when cert is not nil.
+func unwrapSNS(msg string, cert *x509.Certificate) (string, error) {
+	var e snsEnvelope
+	if err := json.Unmarshal([]byte(msg), &e); err != nil {
+		return "", err
+	}
+	if cert != nil {
+		if err := verifySNSSignature(e, cert); err != nil {
+			return "", fmt.Errorf("SNS message %s from %s: %v", e.MessageID, e.TopicArn, err)
+		}
+	}
+	return e.Message, nil
+}
+
+// verifySNSSignature checks the envelope was signed by cert, see
+// https://docs.aws.amazon.com/sns/latest/dg/sns-verify-signature-of-message.html
+func verifySNSSignature(e snsEnvelope, cert *x509.Certificate) error {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate does not hold an RSA public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Message\n" + e.Message + "\n")
+	buf.WriteString("MessageId\n" + e.MessageID + "\n")
+	if e.Subject != "" {
+		buf.WriteString("Subject\n" + e.Subject + "\n")
+	}
+	buf.WriteString("Timestamp\n" + e.Timestamp + "\n")
+	buf.WriteString("TopicArn\n" + e.TopicArn + "\n")
+	buf.WriteString("Type\n" + e.Type + "\n")
+
+	switch e.SignatureVersion {
+	case "1":
+		h := sha1.Sum(buf.Bytes())
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA1, h[:], sig)
+	case "2":
+		h := sha256.Sum256(buf.Bytes())
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig)
+	default:
+		return fmt.Errorf("unsupported signature version %q", e.SignatureVersion)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testSNSCertificate(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.us-west-2.amazonaws.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func testSNSEnvelope(t *testing.T, key *rsa.PrivateKey, message string) string {
+	e := snsEnvelope{
+		Type:             "Notification",
+		MessageID:        "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		TopicArn:         "arn:aws:sns:us-west-2:123456789012:cloudfront-logs",
+		Message:          message,
+		Timestamp:        "2018-03-01T01:02:03.000Z",
+		SignatureVersion: "2",
+	}
+	h := sha256.Sum256([]byte("Message\n" + e.Message + "\nMessageId\n" + e.MessageID +
+		"\nTimestamp\n" + e.Timestamp + "\nTopicArn\n" + e.TopicArn + "\nType\n" + e.Type + "\n"))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUnwrapSNS(t *testing.T) {
+	key, cert := testSNSCertificate(t)
+	record := `{"x-edge-location":"SYD1","c-ip":"1.8.1.160"}`
+	envelope := testSNSEnvelope(t, key, record)
+
+	if !isSNSEnvelope(envelope) {
+		t.Errorf("isSNSEnvelope(%s): expected true, actual false", envelope)
+	}
+	if isSNSEnvelope(record) {
+		t.Errorf("isSNSEnvelope(%s): expected false, actual true", record)
+	}
+
+	for _, c := range []*x509.Certificate{nil, cert} {
+		actual, err := unwrapSNS(envelope, c)
+		if err != nil {
+			t.Errorf("unwrapSNS: unexpected error %v", err)
+		}
+		if actual != record {
+			t.Errorf("unwrapSNS: expected %v, actual %v", record, actual)
+		}
+	}
+
+	// A tampered message must fail verification.
+	var e snsEnvelope
+	json.Unmarshal([]byte(envelope), &e)
+	e.Message = `{"x-edge-location":"MEL50"}`
+	tampered, _ := json.Marshal(e)
+	if _, err := unwrapSNS(string(tampered), cert); err == nil {
+		t.Errorf("unwrapSNS: expected error for tampered message, actual nil")
+	}
+
+	// Once envelopes are verified, a message sent unwrapped is rejected.
+	if err := checkSNSEnvelope(envelope, cert); err != nil {
+		t.Errorf("checkSNSEnvelope: unexpected error %v", err)
+	}
+	if err := checkSNSEnvelope(record, cert); err == nil {
+		t.Errorf("checkSNSEnvelope(%s): expected error, actual nil", record)
+	}
+	if err := checkSNSEnvelope(record, nil); err != nil {
+		t.Errorf("checkSNSEnvelope(%s) without certificate: unexpected error %v", record, err)
+	}
+}
+
+func TestIsS3Event(t *testing.T) {
+	var data = []struct {
+		msg      string
+		expected bool
+	}{
+		{`{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"}}}]}`, true},
+		{`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"logs"}`, true},
+		{`{"x-edge-location":"SYD1","c-ip":"1.8.1.160"}`, false},
+	}
+
+	for _, tt := range data {
+		if actual := isS3Event(tt.msg); actual != tt.expected {
+			t.Errorf("isS3Event(%s): expected %v, actual %v", tt.msg, tt.expected, actual)
+		}
+	}
+}
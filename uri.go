@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// uriRule rewrites a URI stem, eg. replacing the ids in it with
+// placeholders, so the stems of requests for the same kind of object share
+// a route template like /{id}/{yyyy}/{mm}/{dd}/{file}.bin.
+type uriRule func(stem string) string
+
+// uriRules are the URI_RULES the cs_uri_stem tag is normalised with, in
+// order.
+var uriRules []uriRule
+
+// uriDetectors are the built in rules by name.
+var uriDetectors = map[string]uriRule{
+	// uuid replaces UUIDs with {uuid}.
+	"uuid": segmentRule(func(s string) string {
+		if isUUID(s) {
+			return "{uuid}"
+		}
+		return s
+	}),
+	// date replaces year, month and day segments with {yyyy}, {mm} and
+	// {dd}, and 2006-01-02 dates with {date}.
+	"date": dateRule,
+	// hex replaces hex ids of 4 or more digits with {id}.
+	"hex": segmentRule(func(s string) string {
+		if len(s) >= 4 && isHex(s) && strings.IndexAny(s, "0123456789") >= 0 {
+			return "{id}"
+		}
+		return s
+	}),
+	// number replaces numbers with {id}.
+	"number": segmentRule(func(s string) string {
+		if isDigits(s) {
+			return "{id}"
+		}
+		return s
+	}),
+	// ext replaces the name of the file a stem ends with with {file},
+	// keeping its extension.
+	"ext": extRule,
+}
+
+// parseURIRules parses rules, each the name of a detector, depth:N, which
+// keeps the first N segments of a stem and replaces the rest with {rest},
+// or PATTERN=>REPLACEMENT, which replaces the matches of a regular
+// expression like regexp.ReplaceAllString. "none" keeps stems as they are.
+func parseURIRules(rules []string) ([]uriRule, error) {
+	var parsed []uriRule
+	for _, v := range rules {
+		v = strings.TrimSpace(v)
+		switch {
+		case v == "" || v == "none":
+			continue
+		case strings.Contains(v, "=>"):
+			parts := strings.SplitN(v, "=>", 2)
+			re, err := regexp.Compile(strings.TrimSpace(parts[0]))
+			if err != nil {
+				return nil, fmt.Errorf("uri rule %q: %v", v, err)
+			}
+			replacement := strings.TrimSpace(parts[1])
+			parsed = append(parsed, func(stem string) string {
+				return re.ReplaceAllString(stem, replacement)
+			})
+		case strings.HasPrefix(v, "depth:"):
+			depth, err := strconv.Atoi(strings.TrimPrefix(v, "depth:"))
+			if err != nil || depth < 1 {
+				return nil, fmt.Errorf("uri rule %q has no positive depth", v)
+			}
+			parsed = append(parsed, depthRule(depth))
+		default:
+			rule, ok := uriDetectors[v]
+			if !ok {
+				return nil, fmt.Errorf("uri rule %q is not a detector, depth:N or PATTERN=>REPLACEMENT", v)
+			}
+			parsed = append(parsed, rule)
+		}
+	}
+	return parsed, nil
+}
+
+// normalizeURI applies rules to stem in order.
+func normalizeURI(rules []uriRule, stem string) string {
+	for _, rule := range rules {
+		stem = rule(stem)
+	}
+	return stem
+}
+
+var emptyURITag = createTag("cs_uri_stem", "")
+
+// uriTags appends the cs_uri_stem tag of a record, its URI stem normalised
+// by URI_RULES, since every object requested would be a time series of its
+// own otherwise. Stems and replacements may hold any character, so the
+// result is made safe to use as a tag value.
+func uriTags(r *Record, tags []string) []string {
+	if r.URIStem == "" {
+		return append(tags, emptyURITag)
+	}
+	return r.tb.add(tags, "cs_uri_stem", tagValue(normalizeURI(uriRules, r.URIStem)))
+}
+
+// segmentRule returns a rule replacing every segment of a stem with what
+// replace returns for it.
+func segmentRule(replace func(segment string) string) uriRule {
+	return func(stem string) string {
+		segments := strings.Split(stem, "/")
+		for i, s := range segments {
+			if s != "" {
+				segments[i] = replace(s)
+			}
+		}
+		return strings.Join(segments, "/")
+	}
+}
+
+func dateRule(stem string) string {
+	segments := strings.Split(stem, "/")
+	for i := 0; i < len(segments); i++ {
+		s := segments[i]
+		switch {
+		case len(s) == 10 && s[4] == '-' && s[7] == '-' && isYear(s[:4]) && isMonth(s[5:7]) && isDay(s[8:]):
+			segments[i] = "{date}"
+		case isYear(s) && i+1 < len(segments) && isMonth(segments[i+1]):
+			segments[i], segments[i+1] = "{yyyy}", "{mm}"
+			i++
+			if i+1 < len(segments) && isDay(segments[i+1]) {
+				segments[i+1] = "{dd}"
+				i++
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func extRule(stem string) string {
+	name := stem[strings.LastIndexByte(stem, '/')+1:]
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 || dot == len(name)-1 {
+		return stem
+	}
+	return stem[:len(stem)-len(name)] + "{file}" + name[dot:]
+}
+
+func depthRule(depth int) uriRule {
+	return func(stem string) string {
+		segments := strings.SplitN(strings.TrimPrefix(stem, "/"), "/", depth+1)
+		if len(segments) <= depth || segments[depth] == "" {
+			return stem
+		}
+		segments[depth] = "{rest}"
+		return "/" + strings.Join(segments, "/")
+	}
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i : i+1]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isYear(s string) bool {
+	return len(s) == 4 && isDigits(s) && (s[:2] == "19" || s[:2] == "20")
+}
+
+func isMonth(s string) bool {
+	return len(s) == 2 && isDigits(s) && s >= "01" && s <= "12"
+}
+
+func isDay(s string) bool {
+	return len(s) == 2 && isDigits(s) && s >= "01" && s <= "31"
+}
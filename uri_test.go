@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeURI(t *testing.T) {
+	defaults, err := parseURIRules([]string{"uuid", "date", "hex", "number", "ext", "depth:8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := parseURIRules([]string{" ^/users/[^/]+ => /users/{user}", "number", "depth:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var data = []struct {
+		rules    []uriRule
+		stem     string
+		expected string
+	}{
+		{defaults, "/8d41/2015/01/22/00.bin", "/{id}/{yyyy}/{mm}/{dd}/{file}.bin"},
+		{defaults, "/api/v2/orders/12345", "/api/v2/orders/{id}"},
+		{defaults, "/cafe/beef/index.html", "/cafe/beef/{file}.html"},
+		{defaults, "/img/123e4567-e89b-12d3-a456-426614174000/thumb.JPG", "/img/{uuid}/{file}.JPG"},
+		{defaults, "/archive/2019-12-31/", "/archive/{date}/"},
+		{defaults, "/2015/13/report", "/{id}/{id}/report"},
+		{defaults, "/.well-known/", "/.well-known/"},
+		{defaults, "/a/b/c/d/e/f/g/h/i/j", "/a/b/c/d/e/f/g/h/{rest}"},
+		{custom, "/users/alice/posts/42", "/users/{user}/{rest}"},
+		{custom, "/users/bob", "/users/{user}"},
+		{nil, "/8d41/2015/01/22/00.bin", "/8d41/2015/01/22/00.bin"},
+	}
+
+	for _, tt := range data {
+		if actual := normalizeURI(tt.rules, tt.stem); actual != tt.expected {
+			t.Errorf("normalizeURI(%s): expected %s, actual %s", tt.stem, tt.expected, actual)
+		}
+	}
+}
+
+func TestURITags(t *testing.T) {
+	defer func(rules []uriRule) { uriRules = rules }(uriRules)
+	var err error
+	if uriRules, err = parseURIRules([]string{"^/a/ => /x|y#z,/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var data = []struct {
+		stem     string
+		expected string
+	}{
+		{"", "cs_uri_stem:"},
+		{"/a/b", "cs_uri_stem:/x_y_z_/b"},
+		{"/c,d/e|f#g", "cs_uri_stem:/c_d/e_f_g"},
+	}
+
+	for _, tt := range data {
+		r := &Record{URIStem: tt.stem}
+		tags := r.tb.build(uriTags(r, nil))
+		if len(tags) != 1 || tags[0] != tt.expected {
+			t.Errorf("uriTags(%s): expected [%s], actual %v", tt.stem, tt.expected, tags)
+		}
+	}
+}
+
+func TestParseURIRules(t *testing.T) {
+	if rules, err := parseURIRules([]string{"none"}); err != nil || len(rules) != 0 {
+		t.Errorf("parseURIRules(none): expected no rules, actual %d %v", len(rules), err)
+	}
+	for _, tt := range []string{"guid", "depth:0", "depth:x", "([a-z]=>x"} {
+		if _, err := parseURIRules([]string{tt}); err == nil {
+			t.Errorf("parseURIRules(%s): expected error, actual nil", tt)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// userAgent is what a client's User-Agent says about it. Fields are "other"
+// when the User-Agent doesn't match any rule, and empty when the request
+// had none.
+type userAgent struct {
+	Browser string
+	// Version is the browser's major version.
+	Version string
+	OS      string
+	// Device is one of desktop, mobile, tablet, tv, bot or other.
+	Device string
+	// Bot is the name of a known crawler, monitor or HTTP library.
+	Bot string
+
+	tags []string
+}
+
+// uaRule names the clients whose User-Agent matches match, unless it also
+// matches unless. The first submatch of a browser rule that matched is the
+// browser's major version.
+type uaRule struct {
+	name   string
+	match  *regexp.Regexp
+	unless *regexp.Regexp
+}
+
+func (r *uaRule) matches(ua string) bool {
+	return r.match.MatchString(ua) && (r.unless == nil || !r.unless.MatchString(ua))
+}
+
+// The rules are tried in order, so rules for clients that mimic others,
+// eg. Edge which also says Chrome and Safari, come first.
+var (
+	uaBotRules = []uaRule{
+		{name: "googlebot", match: regexp.MustCompile(`Googlebot|AdsBot-Google|Mediapartners-Google|Google-InspectionTool|APIs-Google|FeedFetcher-Google`)},
+		{name: "bingbot", match: regexp.MustCompile(`bingbot|BingPreview|msnbot|adidxbot`)},
+		{name: "yahoo", match: regexp.MustCompile(`Yahoo! Slurp`)},
+		{name: "duckduckbot", match: regexp.MustCompile(`DuckDuckBot|DuckDuckGo-Favicons-Bot`)},
+		{name: "baiduspider", match: regexp.MustCompile(`Baiduspider`)},
+		{name: "yandexbot", match: regexp.MustCompile(`Yandex[A-Za-z]*Bot|YandexImages`)},
+		{name: "applebot", match: regexp.MustCompile(`Applebot`)},
+		{name: "facebook", match: regexp.MustCompile(`facebookexternalhit|facebookcatalog|Facebot|meta-externalagent`)},
+		{name: "twitterbot", match: regexp.MustCompile(`Twitterbot`)},
+		{name: "linkedinbot", match: regexp.MustCompile(`LinkedInBot`)},
+		{name: "slackbot", match: regexp.MustCompile(`Slackbot|Slack-ImgProxy`)},
+		{name: "discordbot", match: regexp.MustCompile(`Discordbot`)},
+		{name: "telegrambot", match: regexp.MustCompile(`TelegramBot`)},
+		{name: "whatsapp", match: regexp.MustCompile(`WhatsApp`)},
+		{name: "pinterestbot", match: regexp.MustCompile(`Pinterestbot|Pinterest/`)},
+		{name: "ahrefsbot", match: regexp.MustCompile(`AhrefsBot|AhrefsSiteAudit`)},
+		{name: "semrushbot", match: regexp.MustCompile(`SemrushBot`)},
+		{name: "mj12bot", match: regexp.MustCompile(`MJ12bot`)},
+		{name: "dotbot", match: regexp.MustCompile(`DotBot`)},
+		{name: "petalbot", match: regexp.MustCompile(`PetalBot`)},
+		{name: "bytespider", match: regexp.MustCompile(`Bytespider`)},
+		{name: "amazonbot", match: regexp.MustCompile(`Amazonbot`)},
+		{name: "gptbot", match: regexp.MustCompile(`GPTBot|ChatGPT-User|OAI-SearchBot`)},
+		{name: "ccbot", match: regexp.MustCompile(`CCBot`)},
+		{name: "uptimerobot", match: regexp.MustCompile(`UptimeRobot`)},
+		{name: "pingdom", match: regexp.MustCompile(`Pingdom`)},
+		{name: "elb-healthchecker", match: regexp.MustCompile(`ELB-HealthChecker`)},
+		{name: "lighthouse", match: regexp.MustCompile(`Chrome-Lighthouse`)},
+		{name: "headlesschrome", match: regexp.MustCompile(`HeadlessChrome`)},
+		{name: "curl", match: regexp.MustCompile(`^curl/`)},
+		{name: "wget", match: regexp.MustCompile(`^Wget/`)},
+		{name: "python", match: regexp.MustCompile(`python-requests|[Pp]ython-urllib|aiohttp|python-httpx`)},
+		{name: "go-http-client", match: regexp.MustCompile(`Go-http-client`)},
+		{name: "java", match: regexp.MustCompile(`^Java/|Apache-HttpClient`)},
+		{name: "node", match: regexp.MustCompile(`^axios/|node-fetch|^undici`)},
+		{name: "other", match: regexp.MustCompile(`(?i)bot\b|crawler|spider|scraper|\bcrawl`)},
+	}
+
+	uaBrowserRules = []uaRule{
+		{name: "Edge", match: regexp.MustCompile(`(?:Edg|Edge|EdgA|EdgiOS)/(\d+)`)},
+		{name: "Opera", match: regexp.MustCompile(`(?:OPR|OPiOS|Opera)/(\d+)`)},
+		{name: "Samsung Internet", match: regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+		{name: "UC Browser", match: regexp.MustCompile(`UCBrowser/(\d+)`)},
+		{name: "Yandex Browser", match: regexp.MustCompile(`YaBrowser/(\d+)`)},
+		{name: "Vivaldi", match: regexp.MustCompile(`Vivaldi/(\d+)`)},
+		{name: "Firefox", match: regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+		{name: "Chrome", match: regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+		{name: "Safari", match: regexp.MustCompile(`Version/(\d+).*Safari/`)},
+		{name: "IE", match: regexp.MustCompile(`MSIE (\d+)|Trident/.*rv:(\d+)`)},
+	}
+
+	uaOSRules = []uaRule{
+		{name: "Windows Phone", match: regexp.MustCompile(`Windows Phone`)},
+		{name: "Windows", match: regexp.MustCompile(`Windows`)},
+		{name: "tvOS", match: regexp.MustCompile(`AppleTV|Apple TV|tvOS`)},
+		{name: "iOS", match: regexp.MustCompile(`iPhone|iPad|iPod`)},
+		{name: "macOS", match: regexp.MustCompile(`Macintosh|Mac OS X`)},
+		{name: "Chrome OS", match: regexp.MustCompile(`CrOS`)},
+		{name: "Fire OS", match: regexp.MustCompile(`AFT[A-Z]|KF[A-Z]{2}|Silk/`)},
+		{name: "Android", match: regexp.MustCompile(`Android`)},
+		{name: "Tizen", match: regexp.MustCompile(`Tizen`)},
+		{name: "webOS", match: regexp.MustCompile(`Web0S|webOS`)},
+		{name: "Roku", match: regexp.MustCompile(`Roku`)},
+		{name: "BlackBerry", match: regexp.MustCompile(`BlackBerry|BB10`)},
+		{name: "Linux", match: regexp.MustCompile(`Linux|X11`)},
+	}
+
+	uaDeviceRules = []uaRule{
+		{name: "tv", match: regexp.MustCompile(`SmartTV|SMART-TV|Smart-TV|SmartHub|HbbTV|NetCast|BRAVIA|CrKey|AppleTV|Apple TV|Roku|AFT[A-Z]|Web0S|GoogleTV|Android TV|\bTV\b`)},
+		{name: "tablet", match: regexp.MustCompile(`iPad|Tablet|Kindle|Silk/|PlayBook|KF[A-Z]{2}`)},
+		// Android tablets are the Android devices that don't say Mobile.
+		{name: "tablet", match: regexp.MustCompile(`Android`), unless: regexp.MustCompile(`Mobi`)},
+		{name: "mobile", match: regexp.MustCompile(`Mobi|iPhone|iPod|Android|Windows Phone|Opera Mini|BlackBerry|BB10`)},
+		{name: "desktop", match: regexp.MustCompile(`Windows|Macintosh|X11|CrOS|Linux`)},
+	}
+)
+
+// userAgentCache holds the classification of recently seen User-Agents,
+// since most requests come from a few popular clients and matching the
+// rules is far slower than a lookup. It is sized by USER_AGENT_CACHE_SIZE.
+var userAgentCache *lruCache
+
+var emptyUserAgent = newUserAgent("", "", "", "", "")
+
+// userAgentTags appends the browser, browser_version, os, device and bot
+// tags of a record's User-Agent, which are added to metrics instead of the
+// User-Agent itself.
+func userAgentTags(r *Record, tags []string) []string {
+	if r.UserAgent == "" {
+		return append(tags, emptyUserAgent.tags...)
+	}
+	if ua, ok := userAgentCache.get(r.UserAgent); ok {
+		return append(tags, ua.(*userAgent).tags...)
+	}
+	ua := classifyUserAgent(r.UserAgent)
+	userAgentCache.add(r.UserAgent, ua)
+	return append(tags, ua.tags...)
+}
+
+// classifyUserAgent matches a User-Agent against the rules. User-Agents are
+// URL encoded in CloudFront logs, which the W3C parser decodes but shippers
+// may not.
+func classifyUserAgent(ua string) *userAgent {
+	if strings.Contains(ua, "%") {
+		if decoded, err := url.PathUnescape(ua); err == nil {
+			ua = decoded
+		}
+	}
+	if strings.TrimSpace(ua) == "" {
+		return emptyUserAgent
+	}
+
+	browser, version := "other", ""
+	for i := range uaBrowserRules {
+		m := uaBrowserRules[i].match.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		browser = uaBrowserRules[i].name
+		for _, v := range m[1:] {
+			if v != "" {
+				version = v
+				break
+			}
+		}
+		break
+	}
+
+	bot := firstRule(uaBotRules, ua, "")
+	device := "bot"
+	if bot == "" {
+		device = firstRule(uaDeviceRules, ua, "other")
+	}
+	return newUserAgent(browser, version, firstRule(uaOSRules, ua, "other"), device, bot)
+}
+
+// firstRule returns the name of the first rule ua matches, or def.
+func firstRule(rules []uaRule, ua, def string) string {
+	for i := range rules {
+		if rules[i].matches(ua) {
+			return rules[i].name
+		}
+	}
+	return def
+}
+
+func newUserAgent(browser, version, os, device, bot string) *userAgent {
+	return &userAgent{
+		Browser: browser,
+		Version: version,
+		OS:      os,
+		Device:  device,
+		Bot:     bot,
+		tags: []string{
+			createTag("browser", browser),
+			createTag("browser_version", version),
+			createTag("os", os),
+			createTag("device", device),
+			createTag("bot", bot),
+		},
+	}
+}
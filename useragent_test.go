@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	var data = []struct {
+		ua       string
+		expected userAgent
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", userAgent{Browser: "Chrome", Version: "120", OS: "Windows", Device: "desktop"}},
+		{"Mozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64)%20AppleWebKit/537.36%20(KHTML,%20like%20Gecko)%20Chrome/120.0.0.0%20Safari/537.36%20Edg/120.0.2210.91", userAgent{Browser: "Edge", Version: "120", OS: "Windows", Device: "desktop"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", userAgent{Browser: "Safari", Version: "17", OS: "macOS", Device: "desktop"}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", userAgent{Browser: "Safari", Version: "17", OS: "iOS", Device: "mobile"}},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/119.0.6045.169 Mobile/15E148 Safari/604.1", userAgent{Browser: "Chrome", Version: "119", OS: "iOS", Device: "tablet"}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Mobile Safari/537.36", userAgent{Browser: "Samsung Internet", Version: "23", OS: "Android", Device: "mobile"}},
+		{"Mozilla/5.0 (Linux; Android 12; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36", userAgent{Browser: "Chrome", Version: "119", OS: "Android", Device: "tablet"}},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", userAgent{Browser: "Firefox", Version: "121", OS: "Linux", Device: "desktop"}},
+		{"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko", userAgent{Browser: "IE", Version: "11", OS: "Windows", Device: "desktop"}},
+		{"Mozilla/5.0 (Linux; Tizen 2.3) AppleWebKit/538.1 (KHTML, like Gecko)Version/2.3 TV Safari/538.1", userAgent{Browser: "Safari", Version: "2", OS: "Tizen", Device: "tv"}},
+		{"Roku/DVP-9.10 (519.10E04111A)", userAgent{Browser: "other", OS: "Roku", Device: "tv"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", userAgent{Browser: "other", OS: "other", Device: "bot", Bot: "googlebot"}},
+		{"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.71 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", userAgent{Browser: "Chrome", Version: "120", OS: "Android", Device: "bot", Bot: "googlebot"}},
+		{"curl/7.58.0", userAgent{Browser: "other", OS: "other", Device: "bot", Bot: "curl"}},
+		{"SomeCrawler/1.0", userAgent{Browser: "other", OS: "other", Device: "bot", Bot: "other"}},
+		{"okhttp/4.9.0", userAgent{Browser: "other", OS: "other", Device: "other"}},
+		{"-", userAgent{Browser: "other", OS: "other", Device: "other"}},
+		{"%20", userAgent{}},
+	}
+
+	for _, tt := range data {
+		actual := *classifyUserAgent(tt.ua)
+		actual.tags = nil
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("classifyUserAgent(%s): expected %+v, actual %+v", tt.ua, tt.expected, actual)
+		}
+	}
+}
+
+func TestUserAgentTags(t *testing.T) {
+	var data = []struct {
+		ua       string
+		expected []string
+	}{
+		{"", []string{"browser:", "browser_version:", "os:", "device:", "bot:"}},
+		{"curl/7.58.0", []string{"browser:other", "browser_version:", "os:other", "device:bot", "bot:curl"}},
+		// A cached classification.
+		{"curl/7.58.0", []string{"browser:other", "browser_version:", "os:other", "device:bot", "bot:curl"}},
+	}
+
+	for _, tt := range data {
+		actual := userAgentTags(&Record{UserAgent: tt.ua}, nil)
+		if diff := deep.Equal(actual, tt.expected); diff != nil {
+			t.Errorf("userAgentTags(%s): expected %v, actual %v", tt.ua, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	statsd "github.com/DataDog/datadog-go/statsd"
+)
+
+// reportFieldErrors counts the missing and invalid fields of a record per
+// field name, so records CloudFront or a shipper got wrong are noticed
+// rather than turned into metrics with blank tags.
+func reportFieldErrors(d metricClient, r *Record, tags []string) {
+	for _, f := range r.Missing {
+		if err := d.Incr("field_missing", withTags(tags, createTag("field", f)), 1); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	for _, f := range r.Invalid {
+		if err := d.Incr("field_invalid", withTags(tags, createTag("field", f)), 1); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+// drift watches the fields records arrive with for every input.
+var drift = newDriftDetector()
+
+// driftDetector notices when the fields of incoming records change, which
+// suggests CloudFront changed its log format: a field that was never seen
+// before appears, or a field that used to be there stops arriving although
+// records still do. Fields are tracked by key, whatever their value, so a
+// field that is mostly "-" doesn't look like it vanished.
+//
+// observe runs for every record, so known fields are updated without
+// locking. Keys come from untrusted input, so only driftMaxFields keys of up
+// to driftMaxKeyLen bytes are tracked.
+type driftDetector struct {
+	// lastSeen maps each field to when it was last seen, as an *int64 of
+	// Unix nanoseconds updated atomically.
+	lastSeen sync.Map
+	// lastRecord is when the last record was observed, in Unix nanoseconds.
+	lastRecord int64
+
+	// mu guards adding fields to lastSeen and the fields below.
+	mu sync.Mutex
+	// fields is the number of fields in lastSeen.
+	fields int
+	// added are the fields first seen since the last report.
+	added []string
+	// warm is set after the first report. The fields seen until then are
+	// the baseline and aren't reported as new.
+	warm bool
+}
+
+const (
+	driftMaxFields = 1000
+	driftMaxKeyLen = 128
+)
+
+func newDriftDetector() *driftDetector {
+	return &driftDetector{}
+}
+
+// observe records the keys of a record.
+func (dd *driftDetector) observe(keys []string, now time.Time) {
+	ns := now.UnixNano()
+	atomic.StoreInt64(&dd.lastRecord, ns)
+	for _, k := range keys {
+		if t, ok := dd.lastSeen.Load(k); ok {
+			atomic.StoreInt64(t.(*int64), ns)
+			continue
+		}
+		if len(k) > driftMaxKeyLen {
+			continue
+		}
+		dd.add(k, ns)
+	}
+}
+
+// add starts tracking a field. The key is copied, since the one passed to
+// observe may point into a whole message.
+func (dd *driftDetector) add(k string, ns int64) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	if _, ok := dd.lastSeen.Load(k); ok || dd.fields >= driftMaxFields {
+		return
+	}
+	k = string(append([]byte(nil), k...))
+	t := ns
+	dd.lastSeen.Store(k, &t)
+	dd.fields++
+	if dd.warm {
+		dd.added = append(dd.added, k)
+	}
+}
+
+// report returns the fields first seen since the last report and the ones
+// not seen for window while records kept arriving. Each change is reported
+// once.
+func (dd *driftDetector) report(now time.Time, window time.Duration) ([]string, []string) {
+	dd.mu.Lock()
+	defer dd.mu.Unlock()
+	added := dd.added
+	dd.added = nil
+	dd.warm = true
+
+	var removed []string
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&dd.lastRecord))) < window {
+		dd.lastSeen.Range(func(k, t interface{}) bool {
+			if now.Sub(time.Unix(0, atomic.LoadInt64(t.(*int64)))) >= window {
+				removed = append(removed, k.(string))
+				dd.lastSeen.Delete(k)
+				dd.fields--
+			}
+			return true
+		})
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// reportDrift sends a single event summarising the field changes found every
+// SCHEMA_DRIFT_INTERVAL.
+func reportDrift(d metricClient, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	window := time.Duration(config.SchemaDriftWindow) * time.Second
+	for now := range time.Tick(time.Duration(config.SchemaDriftInterval) * time.Second) {
+		added, removed := drift.report(now, window)
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		text := fmt.Sprintf("new fields: %s; vanished fields: %s", strings.Join(added, ", "), strings.Join(removed, ", "))
+		log.Printf("log schema drift: %s", text)
+		sendEvent(d, statsd.Event{
+			Title:     "log schema drift",
+			Text:      text,
+			AlertType: statsd.Warning,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestNewRecordValidation(t *testing.T) {
+	var data = []struct {
+		raw     logRecord
+		missing []string
+		invalid []string
+	}{
+		{
+			logRecord{"c-ip": "1.8.1.160", "time-taken": "1.14", "x-edge-location": "SYD1", "x-edge-result-type": "Hit", "cs-method": "GET", "sc-status": "200"},
+			nil,
+			nil,
+		},
+		{
+			logRecord{"c-ip": "1.8.1.160", "time-taken": "-", "x-edge-result-type": "Teleported", "cs-method": "GET", "sc-status": "200", "cs-protocol": "gopher"},
+			[]string{"time-taken", "x-edge-location"},
+			[]string{"x-edge-result-type", "cs-protocol"},
+		},
+	}
+
+	for _, tt := range data {
+		r := newRecord(tt.raw)
+		if diff := deep.Equal(r.Missing, tt.missing); diff != nil {
+			t.Errorf("newRecord(%v): expected missing %v, actual %v", tt.raw, tt.missing, r.Missing)
+		}
+		if diff := deep.Equal(r.Invalid, tt.invalid); diff != nil {
+			t.Errorf("newRecord(%v): expected invalid %v, actual %v", tt.raw, tt.invalid, r.Invalid)
+		}
+	}
+
+	// Values outside an enum are still kept.
+	if r := newRecord(logRecord{"x-edge-result-type": "Teleported"}); r.EdgeResultType != "Teleported" {
+		t.Errorf("newRecord: expected Teleported, actual %q", r.EdgeResultType)
+	}
+}
+
+func TestReportFieldErrors(t *testing.T) {
+	var out bytes.Buffer
+	reportFieldErrors(&printClient{w: &out}, &Record{Missing: []string{"c-ip"}, Invalid: []string{"sc-status"}}, []string{"club_name:test"})
+	expected := "field_missing:1|c|#club_name:test,field:c-ip\nfield_invalid:1|c|#club_name:test,field:sc-status\n"
+	if out.String() != expected {
+		t.Errorf("reportFieldErrors: expected %q, actual %q", expected, out.String())
+	}
+}
+
+func TestDriftDetector(t *testing.T) {
+	dd := newDriftDetector()
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	window := time.Hour
+
+	var data = []struct {
+		records [][]string
+		at      time.Duration
+		added   []string
+		removed []string
+	}{
+		// The fields seen before the first report are the baseline.
+		{[][]string{{"c-ip", "x-edge-location", "cs-referer"}, {"c-country"}}, 0, nil, nil},
+		{[][]string{{"c-ip", "x-edge-location", "c-country"}}, 30 * time.Minute, nil, nil},
+		{[][]string{{"c-ip", "x-edge-location", "sc-bytes"}}, 61 * time.Minute, []string{"sc-bytes"}, []string{"cs-referer"}},
+		// Fields don't vanish while no records arrive at all.
+		{nil, 4 * time.Hour, nil, nil},
+	}
+
+	for _, tt := range data {
+		now := start.Add(tt.at)
+		for _, keys := range tt.records {
+			dd.observe(keys, now)
+		}
+		added, removed := dd.report(now, window)
+		if diff := deep.Equal(added, tt.added); diff != nil {
+			t.Errorf("report(%s): expected added %v, actual %v", tt.at, tt.added, added)
+		}
+		if diff := deep.Equal(removed, tt.removed); diff != nil {
+			t.Errorf("report(%s): expected removed %v, actual %v", tt.at, tt.removed, removed)
+		}
+	}
+}
+
+func TestDriftDetectorLimits(t *testing.T) {
+	dd := newDriftDetector()
+	now := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	dd.report(now, time.Hour)
+
+	keys := make([]string, driftMaxFields+10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("field-%d", i)
+	}
+	dd.observe(append(keys, strings.Repeat("a", driftMaxKeyLen+1)), now)
+
+	added, _ := dd.report(now, time.Hour)
+	if len(added) != driftMaxFields {
+		t.Errorf("report: expected %d added, actual %d", driftMaxFields, len(added))
+	}
+}
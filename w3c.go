@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// maxLogLineSize is the longest log line we accept. CloudFront lines are
+// usually well under 2KB but long query strings and cookies can push them
+// beyond bufio.Scanner's 64KB default.
+const maxLogLineSize = 1024 * 1024
+
+// defaultW3CFields is the column order of CloudFront standard logs. It is
+// used for lines that arrive without a preceding #Fields directive, eg. a
+// single raw log line put on the queue.
+var defaultW3CFields = []string{
+	"date",
+	"time",
+	"x-edge-location",
+	"sc-bytes",
+	"c-ip",
+	"cs-method",
+	"cs(Host)",
+	"cs-uri-stem",
+	"sc-status",
+	"cs(Referer)",
+	"cs(User-Agent)",
+	"cs-uri-query",
+	"cs(Cookie)",
+	"x-edge-result-type",
+	"x-edge-request-id",
+	"x-host-header",
+	"cs-protocol",
+	"cs-bytes",
+	"time-taken",
+	"x-forwarded-for",
+	"ssl-protocol",
+	"ssl-cipher",
+	"x-edge-response-result-type",
+	"cs-protocol-version",
+	"fle-status",
+	"fle-encrypted-fields",
+	"c-port",
+	"time-to-first-byte",
+	"x-edge-detailed-result-type",
+	"sc-content-type",
+	"sc-content-len",
+	"sc-range-start",
+	"sc-range-end",
+}
+
+// w3cEncodedFields are the fields CloudFront URL encodes. Spaces are written
+// as %20 and a literal "%" as %25. Other values are kept as is and checked
+// against the schema like those of any other format.
+var w3cEncodedFields = map[string]bool{
+	"cs(User-Agent)": true,
+	"cs(Referer)":    true,
+	"cs(Cookie)":     true,
+}
+
+// w3cParser parses CloudFront logs in the W3C extended log file format.
+// A parser remembers the last #Fields directive it has seen, so one parser
+// must be used per log file.
+type w3cParser struct {
+	fields []string
+}
+
+func newW3CParser() *w3cParser {
+	return &w3cParser{fields: defaultW3CFields}
+}
+
+// parseLine parses a single log line. Directives such as #Version and
+// #Fields return a nil record.
+func (p *w3cParser) parseLine(line string) (logRecord, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(line, "#") {
+		if strings.HasPrefix(line, "#Fields:") {
+			fields := strings.Fields(strings.TrimPrefix(line, "#Fields:"))
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("empty #Fields directive")
+			}
+			p.fields = fields
+		}
+		return nil, nil
+	}
+
+	values := strings.Split(line, "\t")
+	if len(values) != len(p.fields) {
+		return nil, fmt.Errorf("expected %d fields, actual %d", len(p.fields), len(values))
+	}
+
+	r := make(logRecord, len(p.fields))
+	for i, f := range p.fields {
+		r[f] = w3cValue(f, values[i])
+	}
+	return r, nil
+}
+
+// w3cValue converts a raw W3C value into the value the JSON log lines carry.
+// CloudFront writes "-" for empty values. A value that is not validly URL
+// encoded is kept as is.
+func w3cValue(field, raw string) string {
+	if raw == "-" || raw == "" {
+		return ""
+	}
+	if w3cEncodedFields[field] {
+		if v, err := url.PathUnescape(raw); err == nil {
+			return v
+		}
+	}
+	return raw
+}
+
+// lineErrFunc receives a log line that could not be parsed.
+type lineErrFunc func(line string, err error)
+
+// readLogLines reads a CloudFront log file and calls fn for every log line.
+// Lines that fail to parse, eg. with the wrong number of columns, are passed
+// to onErr and skipped rather than failing the whole file. It returns the
+// number of lines passed to fn.
+func readLogLines(rd io.Reader, fn func(logRecord), onErr lineErrFunc) (int, error) {
+	p := newW3CParser()
+	n := 0
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		r, err := p.parseLine(scanner.Text())
+		if err != nil {
+			onErr(scanner.Text(), err)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		fn(r)
+		n++
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testLogLine = "2018-03-01\t01:02:03\tSYD1\t1045619\t1.8.1.160\tGET\td111111abcdef8.cloudfront.net\t/8d41/2015/01/22/00.bin\t200\t-\tMozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64)\tformat=mp4&v=2\t-\tHit\tSOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==\tcdn.example.com\thttps\t23\t0.100\t-\tTLSv1.2\tECDHE-RSA-AES128-GCM-SHA256\tHit\tHTTP/2.0\t-\t-\t11040\t0.099\tHit\tapplication/octet-stream\t1045619\t-\t-"
+
+func TestW3CValue(t *testing.T) {
+	var data = []struct {
+		field    string
+		raw      string
+		expected string
+	}{
+		{"x-edge-location", "SYD1", "SYD1"},
+		{"cs(Referer)", "-", ""},
+		{"sc-status", "200", "200"},
+		{"time-taken", "0.100", "0.100"},
+		{"sc-status", "abc", "abc"},
+		{"cs(User-Agent)", "Mozilla/5.0%20(X11;%20Linux%20x86_64)", "Mozilla/5.0 (X11; Linux x86_64)"},
+		{"cs(User-Agent)", "curl/7.58.0%2520test", "curl/7.58.0%20test"},
+		{"cs-uri-query", "a=b%20c", "a=b%20c"},
+		{"cs(Referer)", "https://example.com/100%", "https://example.com/100%"},
+	}
+
+	for _, tt := range data {
+		actual := w3cValue(tt.field, tt.raw)
+		if actual != tt.expected {
+			t.Errorf("w3cValue(%s, %s): expected %v, actual %v", tt.field, tt.raw, tt.expected, actual)
+		}
+	}
+}
+
+func TestW3CParserParseLine(t *testing.T) {
+	p := newW3CParser()
+
+	r, err := p.parseLine(testLogLine)
+	if err != nil {
+		t.Fatalf("parseLine: unexpected error %v", err)
+	}
+	var data = []struct {
+		field    string
+		expected string
+	}{
+		{"c-ip", "1.8.1.160"},
+		{"x-edge-location", "SYD1"},
+		{"time-taken", "0.100"},
+		{"cs(User-Agent)", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"},
+		{"cs(Referer)", ""},
+		{"cs-uri-query", "format=mp4&v=2"},
+		{"sc-range-end", ""},
+	}
+	for _, tt := range data {
+		if r[tt.field] != tt.expected {
+			t.Errorf("parseLine: %s expected %v, actual %v", tt.field, tt.expected, r[tt.field])
+		}
+	}
+
+	// The #Fields directive replaces the default column order.
+	if r, err := p.parseLine("#Fields: c-ip x-edge-location"); r != nil || err != nil {
+		t.Errorf("parseLine(#Fields): expected nil record and error, actual %v %v", r, err)
+	}
+	r, err = p.parseLine("1.8.1.161\tMEL50")
+	if err != nil || r["x-edge-location"] != "MEL50" {
+		t.Errorf("parseLine: expected MEL50, actual %v %v", r, err)
+	}
+
+	if _, err := p.parseLine("1.8.1.161\tMEL50\textra"); err == nil {
+		t.Errorf("parseLine: expected error for extra column, actual nil")
+	}
+}
+
+func TestReadLogLines(t *testing.T) {
+	var records []logRecord
+	var broken []string
+	n, err := readLogLines(strings.NewReader(testLogFile+"broken line\n"), func(r logRecord) {
+		records = append(records, r)
+	}, func(line string, err error) {
+		broken = append(broken, line)
+	})
+	if err != nil {
+		t.Fatalf("readLogLines: unexpected error %v", err)
+	}
+	if n != 2 || len(records) != 2 {
+		t.Fatalf("readLogLines: expected 2 lines, actual %d", n)
+	}
+	if records[1]["x-edge-location"] != "MEL50" || records[1]["sc-status"] != "404" {
+		t.Errorf("readLogLines: unexpected record %v", records[1])
+	}
+	if len(broken) != 1 || broken[0] != "broken line" {
+		t.Errorf("readLogLines: expected [broken line] to fail, actual %v", broken)
+	}
+
+	// Without #Fields lines are read using the standard CloudFront columns.
+	n, err = readLogLines(strings.NewReader(testLogLine), func(r logRecord) {
+		if r["x-host-header"] != "cdn.example.com" {
+			t.Errorf("readLogLines: expected cdn.example.com, actual %v", r["x-host-header"])
+		}
+	}, func(line string, err error) {
+		t.Errorf("readLogLines: unexpected error %q %v", line, err)
+	})
+	if err != nil || n != 1 {
+		t.Errorf("readLogLines: expected 1 line, actual %d %v", n, err)
+	}
+}